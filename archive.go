@@ -58,7 +58,6 @@ func (e *buildEnv) archive() error {
 		return err
 	}
 
-	apkgOut := "/tmp/apkg"
 	e.backend.MkdirAll(apkgOut, 0755)
 	if !e.backend.IsLocal() {
 		// also make dir locally if using qemu
@@ -84,6 +83,8 @@ func (e *buildEnv) archive() error {
 				return fmt.Errorf("while fetching from qemu: %w", err)
 			}
 		}
+		e.files = append(e.files, squash)
+		events.emit(&buildEvent{Type: "package", Package: sub, File: squash})
 		if e.backend.IsRoot() {
 			// copy to /var/lib/apkg/unsigned
 			e.run("cp", squash, filepath.Join("/var/lib/apkg/unsigned", filepath.Base(squash)))
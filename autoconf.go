@@ -10,128 +10,97 @@ import (
 	"mvdan.cc/sh/v3/shell"
 )
 
-func (e *buildEnv) buildAutoconf() error {
+func (e *buildEnv) buildAutoconf() (*engineSteps, error) {
 	var err error
 	// perform autoconf build
-	opts := make(map[string]bool)
-
-	// read options
-	for _, opt := range e.i.Options {
-		opts[opt] = true
-	}
-
-	// ensure we have up to date config.sub & config.guess
-	flist := e.backend.FindFiles(e.workdir, "config.sub", "config.guess")
-	for _, f := range flist {
-		log.Printf("upgrading %s", f)
-		e.run("cp", "-f", filepath.Join("/pkg/main/sys-devel.gnuconfig.core/share/gnuconfig", filepath.Base(f)), filepath.Join(e.workdir, f))
-	}
-
-	err = e.runManyIn(e.src, e.i.ConfigurePre)
-	if err != nil {
-		return err
-	}
-
-	if _, autoreconf := opts["autoreconf"]; autoreconf {
-		log.Printf("Running autoreconf tools...")
-		libtoolize := []string{"libtoolize", "--force", "--install"}
-		reconf := []string{"autoreconf", "-fi", "-I", "/pkg/main/azusa.symlinks.core/share/aclocal/"}
-
-		if _, err := e.backend.Stat(filepath.Join(e.src, "m4")); err == nil {
-			reconf = append(reconf, "-I", filepath.Join(e.src, "m4"))
-		}
-
-		err = e.runIn(e.src, libtoolize...)
-		if err != nil {
-			return err
-		}
-		err = e.runIn(e.src, reconf...)
-		if err != nil {
-			return err
-		}
-	}
-
-	cnf := e.findConfigure()
-	if cnf == "" {
-		return fmt.Errorf("could not find configure")
-	}
-
-	args := []string{cnf, "--prefix=" + e.getDir("core")}
-
-	if _, light := opts["light"]; !light {
-		// not in light mode
-		args = append(args,
-			"--sysconfdir=/etc",
-			"--host="+e.chost,
-			"--build="+e.chost,
-			"--includedir="+e.getDir("dev")+"/include",
-			"--libdir="+e.getDir("libs")+"/lib"+e.libsuffix,
-			"--datarootdir="+e.getDir("core")+"/share",
-			"--mandir="+e.getDir("doc")+"/man",
-		)
-		if _, mode213 := opts["213"]; !mode213 {
-			// not in mode 213 either, add more
-			args = append(args,
-				"--docdir="+e.getDir("doc")+"/doc",
-			)
-		}
-	}
 
+	var extraArgs []string
 	for _, arg := range e.i.Arguments {
 		arg, err = shell.Expand(arg, e.getVar)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		args = append(args, arg)
+		extraArgs = append(extraArgs, arg)
 	}
 
 	buildDir := e.temp
 
-	if _, inPlace := opts["build_in_tree"]; inPlace {
-		buildDir = filepath.Dir(cnf)
-	}
-
-	err = e.runIn(buildDir, args...)
-	if err != nil {
-		return err
-	}
-
-	err = e.runManyIn(filepath.Dir(cnf), e.i.ConfigurePost)
-	if err != nil {
-		return err
-	}
-
-	err = e.runManyIn(buildDir, e.i.CompilePre)
-	if err != nil {
-		return err
+	if e.i.hasOption("build_in_tree") {
+		buildDir = e.src
 	}
 
-	err = e.runIn(buildDir, "make", "-j"+strconv.Itoa(runtime.NumCPU()))
-	if err != nil {
-		return err
-	}
+	configure := func() error {
+		// ensure we have up to date config.sub & config.guess
+		flist := e.backend.FindFiles(e.workdir, "config.sub", "config.guess")
+		for _, f := range flist {
+			log.Printf("upgrading %s", f)
+			e.run("cp", "-f", filepath.Join("/pkg/main/sys-devel.gnuconfig.core/share/gnuconfig", filepath.Base(f)), filepath.Join(e.workdir, f))
+		}
 
-	err = e.runManyIn(buildDir, e.i.CompilePost)
-	if err != nil {
-		return err
-	}
+		if e.i.hasOption("autoreconf") {
+			log.Printf("Running autoreconf tools...")
+			libtoolize := []string{"libtoolize", "--force", "--install"}
+			reconf := []string{"autoreconf", "-fi", "-I", "/pkg/main/azusa.symlinks.core/share/aclocal/"}
+
+			if _, err := e.backend.Stat(filepath.Join(e.src, "m4")); err == nil {
+				reconf = append(reconf, "-I", filepath.Join(e.src, "m4"))
+			}
+
+			err := e.runIn(e.src, libtoolize...)
+			if err != nil {
+				return err
+			}
+			err = e.runIn(e.src, reconf...)
+			if err != nil {
+				return err
+			}
+		}
 
-	err = e.runManyIn(buildDir, e.i.InstallPre)
-	if err != nil {
-		return err
-	}
+		cnf := e.findConfigure()
+		if cnf == "" {
+			return fmt.Errorf("could not find configure")
+		}
 
-	err = e.runIn(buildDir, "make", "install", "DESTDIR="+e.dist, "LDCONFIG=/bin/true")
-	if err != nil {
-		return err
-	}
+		args := []string{cnf, "--prefix=" + e.getDir("core")}
 
-	err = e.runManyIn(buildDir, e.i.InstallPost)
-	if err != nil {
-		return err
-	}
+		if !e.i.hasOption("light") {
+			// not in light mode
+			args = append(args,
+				"--sysconfdir=/etc",
+				"--host="+e.chost,
+				"--build="+e.chost,
+				"--includedir="+e.getDir("dev")+"/include",
+				"--libdir="+e.getDir("libs")+"/lib"+e.libsuffix,
+				"--datarootdir="+e.getDir("core")+"/share",
+				"--mandir="+e.getDir("doc")+"/man",
+			)
+			if !e.i.hasOption("213") {
+				// not in mode 213 either, add more
+				args = append(args,
+					"--docdir="+e.getDir("doc")+"/doc",
+				)
+			}
+		}
 
-	return nil
+		args = append(args, extraArgs...)
+
+		return e.runIn(buildDir, args...)
+	}
+
+	return &engineSteps{
+		dir:       buildDir,
+		configure: configure,
+		compile: func() error {
+			return e.runIn(buildDir, "make", "-j"+strconv.Itoa(runtime.NumCPU()))
+		},
+		test: func() error {
+			return e.runIn(buildDir, "make", "check")
+		},
+		install: func() error {
+			return e.runIn(buildDir, "make", "install", "DESTDIR="+e.dist, "LDCONFIG=/bin/true")
+		},
+		configurePostDir: e.src,
+	}, nil
 }
 
 func (e *buildEnv) findConfigure() string {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io"
 	"io/fs"
 	"net"
@@ -12,7 +13,10 @@ type Backend interface {
 	Base() (string, error)
 	IsLocal() bool
 	IsRoot() bool
-	RunEnv(dir string, args []string, env []string, stdout, stderr io.Writer) error
+	// RunEnv runs a command, killing it if ctx is done
+	RunEnv(ctx context.Context, dir string, args []string, env []string, stdout, stderr io.Writer) error
+	Shell(dir string, env []string) error // interactive shell attached to the terminal
+	SetNetwork(enabled bool) error        // allow or deny network access to commands
 	MkdirAll(dir string, mode fs.FileMode) error
 	Mkdir(dir string, mode fs.FileMode) error
 	ReadFile(filename string) ([]byte, error)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +19,7 @@ import (
 )
 
 type buildEnv struct {
+	ctx       context.Context // cancelled on interrupt, or when the phase times out
 	backend   Backend
 	pkg       *pkg
 	i         *buildInstructions
@@ -39,6 +41,16 @@ type buildEnv struct {
 	dist    string // D=$PKGBASE/dist
 	temp    string // T=$PKGBASE/temp
 	src     string // S=...
+
+	resume  bool         // continuing a previous build (-from or shell)
+	state   *buildState  // saved after each phase
+	steps   *engineSteps // set by initEngine
+	testErr error        // set if the test suite failed but failures are allowed
+	log     *buildLog    // set while building
+	files   []string     // squashfs files produced by archive
+
+	backendName string // "local", "qemu", "sandbox", "rootfs", "qemu-user", "builder"
+	offline     bool   // network access is disabled
 }
 
 type buildVersions struct {
@@ -60,8 +72,12 @@ type buildInstructions struct {
 	ConfigurePost []string `yaml:"configure_post,omitempty"`
 	CompilePre    []string `yaml:"compile_pre,omitempty"`
 	CompilePost   []string `yaml:"compile_post,omitempty"`
+	TestPre       []string `yaml:"test_pre,omitempty"`
+	TestPost      []string `yaml:"test_post,omitempty"`
 	InstallPre    []string `yaml:"install_pre,omitempty"`
 	InstallPost   []string `yaml:"install_post,omitempty"`
+
+	Timeouts map[string]time.Duration `yaml:"timeouts,omitempty"` // maximum duration of each phase
 }
 
 type buildConfig struct {
@@ -135,11 +151,15 @@ func (e *buildEnv) initVars() error {
 	e.category = path.Dir(e.pkg.fn) // category, eg. app-arch
 	e.name = path.Base(e.pkg.fn)    // zlib
 
+	// backends need to know what the build imports
+	e.initInstructions()
+
 	e.backend = NewLocal()
+	e.backendName = "local"
 
-	err := e.initQemu()
+	err := e.initBackend()
 	if err != nil {
-		log.Printf("WARNING: failed to init qemu: %s (will build locally)", err)
+		return err
 	}
 
 	tmpbase, err := e.backend.Base()
@@ -147,7 +167,7 @@ func (e *buildEnv) initVars() error {
 		return err
 	}
 
-	e.base = filepath.Join(tmpbase, e.name+"-"+e.version)
+	e.base = filepath.Join(tmpbase, e.baseName())
 	e.workdir = filepath.Join(e.base, "work")
 	e.dist = filepath.Join(e.base, "dist")
 	e.temp = filepath.Join(e.base, "temp")
@@ -207,7 +227,88 @@ func (e *buildEnv) initVars() error {
 	return nil
 }
 
-func (e *buildEnv) initDir() error {
+// baseName is the name of the build directory in the base directory of the
+// backend
+func (e *buildEnv) baseName() string {
+	return e.name + "-" + e.version
+}
+
+// backendFor returns the backend to use for arch. spec is either the name of
+// a backend, or a list of arch=backend separated by commas.
+func backendFor(spec, arch string) string {
+	if !strings.Contains(spec, "=") {
+		return spec
+	}
+	for _, f := range strings.Split(spec, ",") {
+		a, b, ok := strings.Cut(f, "=")
+		if ok && a == arch {
+			return b
+		}
+	}
+	return ""
+}
+
+func (e *buildEnv) initBackend() error {
+	if *buildBuilder != "" {
+		if *buildBackend != "" {
+			return errors.New("-builder and -backend can't be used together")
+		}
+		return e.initBuilder(*buildBuilder)
+	}
+
+	backend := backendFor(*buildBackend, e.arch)
+	switch backend {
+	case "":
+		err := e.initQemu()
+		if err != nil {
+			log.Printf("WARNING: failed to init qemu: %s (will build locally)", err)
+		}
+		return nil
+	case "local":
+		return nil
+	case "qemu":
+		return e.initQemu()
+	case "sandbox":
+		be, err := NewSandbox()
+		if err != nil {
+			return err
+		}
+		e.backend = be
+		e.backendName = "sandbox"
+		return nil
+	case "rootfs":
+		be, err := NewRootfs(e.os, e.arch, e.rootfsPackages())
+		if err != nil {
+			return err
+		}
+		e.backend = be
+		e.backendName = "rootfs"
+		return nil
+	case "qemu-user":
+		be, err := NewQemuUserBackend(e.os, e.arch, e.rootfsPackages())
+		if err != nil {
+			log.Printf("WARNING: failed to init qemu-user: %s (will use the QEMU VM)", err)
+			return e.initQemu()
+		}
+		e.backend = be
+		e.backendName = "qemu-user"
+		return nil
+	}
+	return fmt.Errorf("unsupported backend %s", backend)
+}
+
+func (e *buildEnv) initDir(resume bool) error {
+	if resume {
+		// keep what is already there
+		for _, sub := range []string{"work", "dist", "temp"} {
+			err := e.backend.MkdirAll(filepath.Join(e.base, sub), 0755)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	// cleanup
 	e.backend.RemoveAll(e.base)
 	err := e.backend.MkdirAll(e.base, 0755)
@@ -245,91 +346,108 @@ func (e *buildEnv) appendVar(k, val, glue string) {
 	}
 }
 
-func (e *buildEnv) build(p *pkg) error {
-	// let's just build latest version
+func (e *buildEnv) initInstructions() {
 	e.i = e.config.getInstructions(e.version)
 	if e.i == nil {
 		e.i = &buildInstructions{Engine: "auto"}
 	}
-	log.Printf("building version %s of %s using %s", e.version, p.fn, e.i.Engine)
+}
 
-	if err := e.initDir(); err != nil {
-		return err
+func (e *buildEnv) build(p *pkg) (err error) {
+	if err := e.openLog(); err != nil {
+		return fmt.Errorf("while creating build log: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			ev := &buildEvent{Type: "error", Error: err.Error()}
+			if e.state != nil {
+				ev.Phase = e.state.Failed
+			}
+			events.emit(ev)
+		}
+		ok := err == nil
+		events.emit(&buildEvent{Type: "build_end", Package: e.pkg.fn, Success: &ok})
+		e.closeLog(err)
+	}()
 
-	e.applyEnv()
+	events.emit(&buildEvent{Type: "build_start", Package: p.fn, Version: e.version, Arch: e.arch})
+	log.Printf("building version %s of %s using %s", e.version, p.fn, e.i.Engine)
 
-	err := e.download()
-	if err != nil {
-		return err
+	for phase := range e.i.Timeouts {
+		if !isPhase(phase) {
+			return fmt.Errorf("timeout set for unknown phase %s, valid phases: %s", phase, strings.Join(buildPhases, ", "))
+		}
 	}
 
-	err = e.applyPatches()
-	if err != nil {
-		return err
+	from := *buildFrom
+	resume := from != ""
+	if resume && !isPhase(from) {
+		return fmt.Errorf("unknown phase %s, valid phases: %s", from, strings.Join(buildPhases, ", "))
 	}
 
-	err = e.doImport()
-	if err != nil {
+	if err := e.initDir(resume); err != nil {
 		return err
 	}
 
-	// we call applyEnv a second time because in some cases we use ${S} which is defined by e.download(), or we use $CPPFLAGS defined by import
 	e.applyEnv()
 
-	if e.i.Engine == "auto" || e.i.Engine == "" {
-		// detect based on files found in src
-		if _, err = e.backend.Stat(filepath.Join(e.src, "CMakeLists.txt")); err == nil {
-			e.i = &buildInstructions{Engine: "cmake"}
-		} else if _, err = e.backend.Stat(filepath.Join(e.src, "meson_options.txt")); err == nil {
-			e.i = &buildInstructions{Engine: "meson"}
-		} else if _, err = e.backend.Stat(filepath.Join(e.src, "configure")); err == nil {
-			e.i = &buildInstructions{Engine: "autoconf"}
-		} else if _, err = e.backend.Stat(filepath.Join(e.src, "configure.ac")); err == nil {
-			e.i = &buildInstructions{Engine: "autoconf", Options: []string{"autoreconf"}}
-		} else {
-			return errors.New("could not detect build type")
+	phases := buildPhases
+	e.state = &buildState{}
+	if resume {
+		if err := e.loadState(from); err != nil {
+			return err
 		}
+		phases = phases[len(e.state.Done):]
 	}
 
-	// ok things are downloaded, now let's see what engine we're using
-	switch e.i.Engine {
-	case "autoconf":
-		if err := e.buildAutoconf(); err != nil {
-			return err
-		}
-	case "cmake":
-		if err := e.buildCmake(); err != nil {
-			return err
-		}
-	case "none":
-		if err := e.buildNone(); err != nil {
+	for _, phase := range phases {
+		if err := e.runPhase(phase); err != nil {
+			if *buildShellOnFailure && e.ctx.Err() == nil {
+				log.Printf("phase %s failed: %s", phase, err)
+				if err := e.openShell(e.state.Dir); err != nil {
+					log.Printf("shell: %s", err)
+				}
+			}
 			return err
 		}
-	case "meson":
-		if err := e.buildMeson(); err != nil {
-			return err
-		}
-	default:
-		return fmt.Errorf("unsupported engine: %s", e.i.Engine)
 	}
 
-	// finalize process: fixelf, organize, archive
-	if err := e.fixElf(); err != nil {
-		return err
-	}
-	if err := e.organize(); err != nil {
-		return err
+	if e.testErr != nil {
+		log.Printf("WARNING: build complete, but the test suite failed: %s", e.testErr)
 	}
-	if err := e.archive(); err != nil {
-		return err
+	if *buildKeep {
+		log.Printf("Keeping build directory %s", e.base)
+	} else {
+		e.cleanup()
 	}
-	e.cleanup()
 	e.backend.Close()
 
 	return nil
 }
 
+// shell opens an interactive shell in the environment of the previous build of
+// this package, in the directory of the phase that failed if any
+func (e *buildEnv) shell() error {
+	defer e.backend.Close()
+
+	st, err := e.readState()
+	if err != nil {
+		return err
+	}
+	e.restoreState(st)
+
+	dir := st.Dir
+	if dir == "" {
+		dir = e.base
+	}
+	return e.openShell(dir)
+}
+
+func (e *buildEnv) openShell(dir string) error {
+	log.Printf("Opening a shell in %s, exit it to continue", dir)
+	return e.backend.Shell(dir, e.fullEnv())
+}
+
 func (e *buildEnv) fullEnv() []string {
 	var env []string
 
@@ -345,10 +463,45 @@ func (e *buildEnv) setCmdEnv(c *exec.Cmd) {
 	c.Env = e.fullEnv()
 }
 
+// runEnv runs a command in the build environment. Output goes to the console
+// and the build log unless redirected.
+func (e *buildEnv) runEnv(dir string, args []string, stdout, stderr io.Writer) error {
+	if e.log == nil {
+		return e.backend.RunEnv(e.ctx, dir, args, e.fullEnv(), stdout, stderr)
+	}
+
+	if stdout == nil {
+		stdout = e.log.stdout
+	}
+	if stderr == nil {
+		stderr = e.log.stderr
+	}
+
+	var watchOut, watchErr *netErrWatcher
+	if e.offline {
+		// one watcher per stream as both are written concurrently
+		watchOut, watchErr = &netErrWatcher{}, &netErrWatcher{}
+		stdout = io.MultiWriter(stdout, watchOut)
+		stderr = io.MultiWriter(stderr, watchErr)
+	}
+
+	events.emit(&buildEvent{Type: "command_start", Phase: e.log.phase, Dir: dir, Args: args})
+	start := time.Now()
+	err := e.backend.RunEnv(e.ctx, dir, args, e.fullEnv(), stdout, stderr)
+	e.log.commandDone(dir, args, time.Since(start), err)
+
+	st := exitStatus(err)
+	events.emit(&buildEvent{Type: "command_end", Phase: e.log.phase, Args: args, ExitStatus: &st, Duration: time.Since(start).Seconds()})
+	if err != nil && watchOut != nil && (watchOut.found || watchErr.found) {
+		return fmt.Errorf("%w (the command tried to access the network, which is disabled after the download phase; add the network option to build.yaml if this is expected)", err)
+	}
+	return err
+}
+
 func (e *buildEnv) run(args ...string) error {
 	log.Printf("build: running %s", strings.Join(args, " "))
 
-	return e.backend.RunEnv("/", args, e.fullEnv(), nil, nil)
+	return e.runEnv("/", args, nil, nil)
 }
 
 func (e *buildEnv) runManyIn(dir string, cmds []string) error {
@@ -364,14 +517,14 @@ func (e *buildEnv) runManyIn(dir string, cmds []string) error {
 func (e *buildEnv) runIn(dir string, args ...string) error {
 	log.Printf("build: running %s", strings.Join(args, " "))
 
-	return e.backend.RunEnv(dir, args, e.fullEnv(), nil, nil)
+	return e.runEnv(dir, args, nil, nil)
 }
 
 func (e *buildEnv) runCapture(args ...string) ([]byte, error) {
 	log.Printf("build: running %s", strings.Join(args, " "))
 
 	buf := &bytes.Buffer{}
-	err := e.backend.RunEnv("/", args, e.fullEnv(), buf, nil)
+	err := e.runEnv("/", args, buf, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -380,7 +533,7 @@ func (e *buildEnv) runCapture(args ...string) ([]byte, error) {
 
 func (e *buildEnv) runCaptureSilent(args ...string) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	err := e.backend.RunEnv("/", args, e.fullEnv(), buf, io.Discard)
+	err := e.runEnv("/", args, buf, io.Discard)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestBackendFor(t *testing.T) {
+	tests := []struct {
+		spec, arch string
+		want       string
+	}{
+		{"", "amd64", ""},
+		{"sandbox", "arm64", "sandbox"},
+		{"amd64=rootfs,arm64=qemu-user", "amd64", "rootfs"},
+		{"amd64=rootfs,arm64=qemu-user", "arm64", "qemu-user"},
+		{"amd64=rootfs,arm64=qemu-user", "386", ""},
+		{"amd64=rootfs,bogus", "amd64", "rootfs"},
+	}
+
+	for _, tt := range tests {
+		if got := backendFor(tt.spec, tt.arch); got != tt.want {
+			t.Errorf("backendFor(%q, %q) = %q, want %q", tt.spec, tt.arch, got, tt.want)
+		}
+	}
+}
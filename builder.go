@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NewBuilderBackend connects to a remote builder from the configuration
+func NewBuilderBackend(b *builderConfig) (Backend, error) {
+	keyData, err := os.ReadFile(expandHome(b.KeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("builder %s: %w", b.Name, err)
+	}
+	key, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("builder %s: failed to parse %s: %w", b.Name, b.KeyFile, err)
+	}
+
+	user := b.User
+	if user == "" {
+		user = "root"
+	}
+	port := b.Port
+	if port == 0 {
+		port = 22
+	}
+
+	cfg := &ssh.ClientConfig{
+		User:    user,
+		Auth:    []ssh.AuthMethod{ssh.PublicKeys(key)},
+		Timeout: 10 * time.Second,
+	}
+	err = b.setHostKey(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("builder %s: %w", b.Name, err)
+	}
+
+	addr := net.JoinHostPort(b.Host, strconv.Itoa(port))
+	log.Printf("builder %s: connecting to %s@%s", b.Name, user, addr)
+
+	sshc, err := ssh.Dial("tcp", addr, cfg)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 && cfg.HostKeyAlgorithms == nil {
+		// the host offered a type of key we don't know, ask for the ones in known_hosts
+		var keys []ssh.PublicKey
+		for _, k := range keyErr.Want {
+			keys = append(keys, k.Key)
+		}
+		cfg.HostKeyAlgorithms = hostKeyAlgorithms(keys...)
+		sshc, err = ssh.Dial("tcp", addr, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("builder %s: %w", b.Name, err)
+	}
+
+	be, err := NewSshBackend(sshc)
+	if err != nil {
+		sshc.Close()
+		return nil, fmt.Errorf("builder %s: %w", b.Name, err)
+	}
+	return be, nil
+}
+
+// setHostKey sets how the host key of the builder is checked in cfg
+func (b *builderConfig) setHostKey(cfg *ssh.ClientConfig) error {
+	if b.HostKey != "" {
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(b.HostKey))
+		if err != nil {
+			return fmt.Errorf("failed to parse host_key: %w", err)
+		}
+		cfg.HostKeyCallback = ssh.FixedHostKey(hostKey)
+		cfg.HostKeyAlgorithms = hostKeyAlgorithms(hostKey)
+		return nil
+	}
+
+	fn := expandHome(b.KnownHosts)
+	if fn == "" {
+		fn = expandHome("~/.ssh/known_hosts")
+	}
+	cb, err := knownhosts.New(fn)
+	if err != nil {
+		return err
+	}
+	cfg.HostKeyCallback = cb
+	return nil
+}
+
+// hostKeyAlgorithms returns the host key algorithms to accept for keys. RSA
+// keys also get the SHA-2 signature algorithms, as ssh-rsa (SHA-1) is
+// disabled by default since OpenSSH 8.8.
+func hostKeyAlgorithms(keys ...ssh.PublicKey) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		algos := []string{k.Type()}
+		if k.Type() == ssh.KeyAlgoRSA {
+			algos = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, a := range algos {
+			if !seen[a] {
+				seen[a] = true
+				res = append(res, a)
+			}
+		}
+	}
+	return res
+}
+
+func (e *buildEnv) initBuilder(name string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	b, err := cfg.builder(name)
+	if err != nil {
+		return err
+	}
+	if b.Arch != e.arch {
+		return fmt.Errorf("builder %s is %s, but building for %s (use -arch %s)", name, b.Arch, e.arch, b.Arch)
+	}
+
+	be, err := NewBuilderBackend(b)
+	if err != nil {
+		return err
+	}
+	e.backend = be
+	e.backendName = "builder"
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPubKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, err := ssh.NewPublicKey(edPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		keys []ssh.PublicKey
+		want []string
+	}{
+		{"none", nil, nil},
+		{"ed25519", []ssh.PublicKey{edPub}, []string{"ssh-ed25519"}},
+		{"rsa", []ssh.PublicKey{rsaPub}, []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"}},
+		{"both", []ssh.PublicKey{edPub, rsaPub, edPub}, []string{"ssh-ed25519", "rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"}},
+	}
+
+	for _, tt := range tests {
+		if got := hostKeyAlgorithms(tt.keys...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: hostKeyAlgorithms() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// sha2Signer refuses ssh-rsa signatures, like OpenSSH 8.8+ does by default
+type sha2Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s sha2Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.KeyAlgoRSA)
+}
+
+func (s sha2Signer) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithm == ssh.KeyAlgoRSA {
+		return nil, errors.New("ssh-rsa signatures are disabled")
+	}
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func TestRSAHostKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := sha2Signer{signer.(ssh.AlgorithmSigner)}
+
+	b := &builderConfig{Name: "test", HostKey: string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))}
+	cfg := &ssh.ClientConfig{User: "root"}
+	if err := b.setHostKey(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(cfg *ssh.ClientConfig) error {
+		srvCfg := &ssh.ServerConfig{NoClientAuth: true}
+		srvCfg.AddHostKey(hostKey)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			conn, _, _, err := ssh.NewServerConn(c, srvCfg)
+			if err == nil {
+				conn.Close()
+			}
+		}()
+
+		sshc, err := ssh.Dial("tcp", l.Addr().String(), cfg)
+		if err != nil {
+			return err
+		}
+		sshc.Close()
+		return nil
+	}
+
+	if err := handshake(cfg); err != nil {
+		t.Errorf("handshake with %v failed: %s", cfg.HostKeyAlgorithms, err)
+	}
+
+	// make sure the server rejects ssh-rsa
+	cfg.HostKeyAlgorithms = []string{ssh.KeyAlgoRSA}
+	if err := handshake(cfg); err == nil {
+		t.Errorf("handshake with %v succeeded", cfg.HostKeyAlgorithms)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// apkgOut is where packages, logs and reports end up
+const apkgOut = "/tmp/apkg"
+
+// buildLog writes the full log of a build to a file next to the packages, and
+// keeps track of phases & commands for the summary written at the end
+type buildLog struct {
+	fn     string
+	f      *os.File
+	file   *log.Logger // only goes to the log file
+	stdout io.Writer   // console + log file
+	stderr io.Writer
+
+	start    time.Time
+	phase    string // current phase
+	phases   []*phaseResult
+	commands []*commandResult
+}
+
+type phaseResult struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration"` // in seconds
+	Failed   bool    `json:"failed,omitempty"`
+}
+
+type commandResult struct {
+	Phase      string   `json:"phase"`
+	Dir        string   `json:"dir"`
+	Args       []string `json:"args"`
+	ExitStatus int      `json:"exit_status"` // -1 if the command could not run
+	Duration   float64  `json:"duration"`
+}
+
+type buildSummary struct {
+	Package     string           `json:"package"`
+	Version     string           `json:"version"`
+	OS          string           `json:"os"`
+	Arch        string           `json:"arch"`
+	Backend     string           `json:"backend"`
+	Start       time.Time        `json:"start"`
+	Duration    float64          `json:"duration"`
+	Success     bool             `json:"success"`
+	FailedPhase string           `json:"failed_phase,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	Phases      []*phaseResult   `json:"phases"`
+	Commands    []*commandResult `json:"commands"`
+	Files       []string         `json:"files"` // squashfs files produced
+	Log         string           `json:"log"`
+}
+
+// logName returns the path of the log and summary of a build without their
+// extension. The start time and pid keep builds of the same package from
+// overwriting each other's logs.
+func (e *buildEnv) logName(start time.Time) string {
+	return filepath.Join(apkgOut, "logs", fmt.Sprintf("%s.%s.%s.%s.%d", e.category, e.name, e.pvrf, start.Format("20060102-150405"), os.Getpid()))
+}
+
+// openLog starts writing everything that goes to the console to the log file
+func (e *buildEnv) openLog() error {
+	start := time.Now()
+	fn := e.logName(start) + ".log"
+	err := os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+
+	e.log = &buildLog{
+		fn:     fn,
+		f:      f,
+		file:   log.New(f, "", log.LstdFlags),
+		stdout: io.MultiWriter(consoleStdout(), f),
+		stderr: io.MultiWriter(os.Stderr, f),
+		start:  start,
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, f))
+	log.Printf("Writing build log to %s", fn)
+	return nil
+}
+
+func (l *buildLog) phaseDone(name string, d time.Duration, err error) {
+	l.phases = append(l.phases, &phaseResult{Name: name, Duration: d.Seconds(), Failed: err != nil})
+}
+
+func (l *buildLog) commandDone(dir string, args []string, d time.Duration, err error) {
+	st := exitStatus(err)
+	l.commands = append(l.commands, &commandResult{Phase: l.phase, Dir: dir, Args: args, ExitStatus: st, Duration: d.Seconds()})
+	l.file.Printf("build: %s exited with status %d after %s", args[0], st, d.Round(time.Millisecond))
+}
+
+// exitStatus returns the exit code of a command based on the error returned
+// by the backend
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+	return -1
+}
+
+// closeLog shows the phase timings, writes the summary report and closes the
+// log file. buildErr is the error the build failed with, if any.
+func (e *buildEnv) closeLog(buildErr error) {
+	l := e.log
+	if l == nil {
+		return
+	}
+	total := time.Since(l.start)
+
+	tbl := &strings.Builder{}
+	fmt.Fprintf(tbl, "%-10s %12s\n", "phase", "duration")
+	for _, p := range l.phases {
+		status := ""
+		if p.Failed {
+			status = " FAILED"
+		}
+		fmt.Fprintf(tbl, "%-10s %12s%s\n", p.Name, time.Duration(p.Duration*float64(time.Second)).Round(time.Millisecond), status)
+	}
+	fmt.Fprintf(tbl, "%-10s %12s", "total", total.Round(time.Millisecond))
+	log.Printf("Phase timings:\n%s", tbl)
+
+	sum := &buildSummary{
+		Package:  e.category + "/" + e.name,
+		Version:  e.version,
+		OS:       e.os,
+		Arch:     e.arch,
+		Backend:  e.backendName,
+		Start:    l.start,
+		Duration: total.Seconds(),
+		Success:  buildErr == nil,
+		Phases:   l.phases,
+		Commands: l.commands,
+		Files:    e.files,
+		Log:      l.fn,
+	}
+	if buildErr != nil {
+		sum.Error = buildErr.Error()
+		if e.state != nil {
+			sum.FailedPhase = e.state.Failed
+		}
+	}
+
+	data, err := json.MarshalIndent(sum, "", "  ")
+	if err == nil {
+		fn := e.logName(e.log.start) + ".json"
+		err = os.WriteFile(fn, append(data, '\n'), 0644)
+		if err == nil {
+			log.Printf("Wrote build summary to %s", fn)
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING: failed to write build summary: %s", err)
+	}
+
+	log.SetOutput(os.Stderr)
+	l.f.Close()
+	e.log = nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+type cargoCrate struct {
+	Name     string
+	Version  string
+	Source   string
+	Checksum string
+}
+
+func (e *buildEnv) buildCargo() (*engineSteps, error) {
+	var err error
+
+	cargoRoot := e.cargoRoot()
+
+	cargoPath := "/pkg/main/dev-lang.rust.core/bin"
+	if !strings.HasPrefix(e.getVar("PATH"), cargoPath+":") {
+		e.vars["PATH"] = cargoPath + ":" + e.getVar("PATH")
+	}
+
+	// keep cargo's state in our temp dir
+	e.vars["CARGO_HOME"] = filepath.Join(e.temp, "cargo-home")
+	e.vars["CARGO_TARGET_DIR"] = filepath.Join(e.temp, "target")
+
+	var args []string
+	for _, arg := range e.i.Arguments {
+		arg, err = shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	buildOpts := append([]string{"cargo", "build", "--release", "--offline", "--locked"}, args...)
+	testOpts := append([]string{"cargo", "test", "--release", "--offline", "--locked"}, args...)
+
+	// cargo install will re-use what was built in CARGO_TARGET_DIR
+	installOpts := []string{
+		"cargo", "install",
+		"--offline", "--locked", "--no-track",
+		"--path", cargoRoot,
+		"--root", filepath.Join(e.dist, e.getDir("core")),
+	}
+	installOpts = append(installOpts, args...)
+
+	buildDir := cargoRoot
+
+	return &engineSteps{
+		dir:       buildDir,
+		configure: e.cargoConfigure,
+		compile: func() error {
+			return e.runIn(buildDir, buildOpts...)
+		},
+		test: func() error {
+			return e.runIn(buildDir, testOpts...)
+		},
+		install: func() error {
+			return e.runIn(buildDir, installOpts...)
+		},
+	}, nil
+}
+
+// cargoRoot returns the directory containing Cargo.toml, $S unless overridden
+// via CARGO_ROOT
+func (e *buildEnv) cargoRoot() string {
+	if v := e.getVar("CARGO_ROOT"); v != "" {
+		return v
+	}
+	return e.src
+}
+
+// cargoDownload downloads all the crates listed in Cargo.lock into
+// $WORKDIR/vendor so cargo can build offline
+func (e *buildEnv) cargoDownload() error {
+	lock, err := e.backend.ReadFile(filepath.Join(e.cargoRoot(), "Cargo.lock"))
+	if err != nil {
+		return fmt.Errorf("cargo: Cargo.lock is required for offline builds: %w", err)
+	}
+
+	crates := parseCargoLock(lock)
+
+	vendorDir := filepath.Join(e.workdir, "vendor")
+	err = e.backend.MkdirAll(vendorDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, crate := range crates {
+		switch {
+		case crate.Source == "":
+			// part of the package itself
+			continue
+		case strings.HasPrefix(crate.Source, "registry+https://github.com/rust-lang/crates.io-index"),
+			strings.HasPrefix(crate.Source, "sparse+https://index.crates.io/"):
+			// crates.io
+		default:
+			return fmt.Errorf("cargo: unsupported source %s for crate %s", crate.Source, crate.Name)
+		}
+
+		fn := crate.Name + "-" + crate.Version + ".crate"
+		u := "https://static.crates.io/crates/" + crate.Name + "/" + fn
+
+		tgt, err := e.fetchFile(u, fn)
+		if err != nil {
+			return err
+		}
+
+		sum := e.config.meta.Files[fn].Hashes["sha256"]
+		if crate.Checksum != "" && crate.Checksum != sum {
+			return fmt.Errorf("cargo: checksum of %s does not match Cargo.lock", fn)
+		}
+
+		workTgt := filepath.Join(vendorDir, fn)
+		err = e.backend.PutFile(tgt, workTgt)
+		if err != nil {
+			return err
+		}
+
+		// crates are .tar.gz files containing a name-version directory
+		err = e.runIn(vendorDir, "tar", "xf", fn)
+		if err != nil {
+			return err
+		}
+		e.backend.Remove(workTgt)
+
+		// cargo requires a checksum file in vendored crates
+		cksum := fmt.Sprintf(`{"files":{},"package":"%s"}`, sum)
+		err = e.backend.WriteFile(filepath.Join(vendorDir, crate.Name+"-"+crate.Version, ".cargo-checksum.json"), []byte(cksum), 0644)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+
+	log.Printf("cargo: vendored %d crates", count)
+	return nil
+}
+
+// cargoConfigure configures cargo to use the crates vendored by cargoDownload
+// instead of crates.io
+func (e *buildEnv) cargoConfigure() error {
+	vendorDir := filepath.Join(e.workdir, "vendor")
+	if _, err := e.backend.Stat(vendorDir); err != nil {
+		return fmt.Errorf("cargo: crates were not vendored, run the download phase again: %w", err)
+	}
+
+	cargoHome := filepath.Join(e.temp, "cargo-home")
+	err := e.backend.MkdirAll(cargoHome, 0755)
+	if err != nil {
+		return err
+	}
+
+	cfg := &bytes.Buffer{}
+	fmt.Fprintf(cfg, "[source.crates-io]\nreplace-with = \"vendored-sources\"\n\n")
+	fmt.Fprintf(cfg, "[source.vendored-sources]\ndirectory = \"%s\"\n", vendorDir)
+
+	return e.backend.WriteFile(filepath.Join(cargoHome, "config.toml"), cfg.Bytes(), 0644)
+}
+
+// parseCargoLock returns the list of packages found in a Cargo.lock file. This
+// only understands the subset of toml cargo uses for lock files.
+func parseCargoLock(data []byte) []*cargoCrate {
+	var res []*cargoCrate
+	var cur *cargoCrate
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && !strings.HasPrefix(line, "[[package]]") && strings.HasSuffix(line, "]") {
+			// another section, such as [metadata]
+			cur = nil
+			continue
+		}
+		if line == "[[package]]" {
+			cur = &cargoCrate{}
+			res = append(res, cur)
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+
+		p := strings.Index(line, " = \"")
+		if p == -1 || !strings.HasSuffix(line, "\"") {
+			// not a string value (for example dependencies list)
+			continue
+		}
+		k := line[:p]
+		v := line[p+4 : len(line)-1]
+
+		switch k {
+		case "name":
+			cur.Name = v
+		case "version":
+			cur.Version = v
+		case "source":
+			cur.Source = v
+		case "checksum":
+			cur.Checksum = v
+		}
+	}
+
+	return res
+}
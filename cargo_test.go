@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCargoLock(t *testing.T) {
+	tests := []struct {
+		name string
+		lock string
+		want []*cargoCrate
+	}{
+		{
+			name: "empty",
+			lock: "",
+			want: nil,
+		},
+		{
+			name: "packages",
+			lock: `# This file is automatically @generated by Cargo.
+version = 3
+
+[[package]]
+name = "foo"
+version = "0.1.0"
+dependencies = [
+ "libc",
+]
+
+[[package]]
+name = "libc"
+version = "0.2.150"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+checksum = "89d92a4743f9a61002fae18374ed11e7973f530cb3a3255fb354818118b2203c"
+`,
+			want: []*cargoCrate{
+				{Name: "foo", Version: "0.1.0"},
+				{
+					Name:     "libc",
+					Version:  "0.2.150",
+					Source:   "registry+https://github.com/rust-lang/crates.io-index",
+					Checksum: "89d92a4743f9a61002fae18374ed11e7973f530cb3a3255fb354818118b2203c",
+				},
+			},
+		},
+		{
+			name: "metadata section",
+			lock: `[[package]]
+name = "bar"
+version = "1.0.0"
+source = "git+https://example.com/bar#abcdef"
+
+[metadata]
+"checksum bar 1.0.0" = "0000"
+name = "ignored"
+`,
+			want: []*cargoCrate{
+				{Name: "bar", Version: "1.0.0", Source: "git+https://example.com/bar#abcdef"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := parseCargoLock([]byte(tt.lock))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseCargoLock() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apkgConfig is the configuration of apkg-build itself, read from
+// apkg-build/config.yaml in the user config directory (eg. ~/.config) or the
+// file given with -config
+type apkgConfig struct {
+	Builders []*builderConfig       `yaml:"builders,omitempty"`
+	Qemu     map[string]*qemuConfig `yaml:"qemu,omitempty"` // by arch
+}
+
+// builderConfig describes a remote machine builds can run on through ssh
+type builderConfig struct {
+	Name    string `yaml:"name"`
+	Arch    string `yaml:"arch"`
+	Host    string `yaml:"host"`
+	Port    int    `yaml:"port,omitempty"` // default 22
+	User    string `yaml:"user,omitempty"` // default root
+	KeyFile string `yaml:"key_file"`
+	// the host key is either given directly (eg. "ssh-ed25519 AAAA...") or
+	// checked against a known_hosts file (default ~/.ssh/known_hosts)
+	HostKey    string `yaml:"host_key,omitempty"`
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+}
+
+func configPath() (string, error) {
+	if *configFile != "" {
+		return *configFile, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apkg-build", "config.yaml"), nil
+}
+
+// loadConfig reads the configuration file. An empty configuration is returned
+// if the default file does not exist.
+func loadConfig() (*apkgConfig, error) {
+	fn, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &apkgConfig{}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && *configFile == "" {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return cfg, nil
+}
+
+func (c *apkgConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, b := range c.Builders {
+		if b.Name == "" {
+			return errors.New("builder without a name")
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("duplicate builder %s", b.Name)
+		}
+		seen[b.Name] = true
+
+		switch "" {
+		case b.Arch:
+			return fmt.Errorf("builder %s: missing arch", b.Name)
+		case b.Host:
+			return fmt.Errorf("builder %s: missing host", b.Name)
+		case b.KeyFile:
+			return fmt.Errorf("builder %s: missing key_file", b.Name)
+		}
+		if b.HostKey != "" && b.KnownHosts != "" {
+			return fmt.Errorf("builder %s: host_key and known_hosts can't be used together", b.Name)
+		}
+	}
+	return c.validateQemu()
+}
+
+func (c *apkgConfig) builder(name string) (*builderConfig, error) {
+	for _, b := range c.Builders {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("builder %s not found in configuration", name)
+}
+
+// expandHome replaces a leading ~/ in p with the home directory
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[2:])
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -17,8 +18,6 @@ import (
 )
 
 func (e *buildEnv) download() error {
-	cacheDir := "/tmp/apkg-data"
-
 	for _, u := range e.i.Source {
 		// TODO need to find a way to specify a different name for saved file, for example gentoo's " -> "
 		u, err := shell.Expand(u, e.getVar)
@@ -33,83 +32,9 @@ func (e *buildEnv) download() error {
 			u = u[:p]
 		}
 
-		tgt := filepath.Join(cacheDir, fn)
-		cacheUrl := "https://pkg.azusa.jp/src/main/" + e.category + "/" + e.name + "/" + fn
-		needUpload := false
-
-		st, err := os.Stat(tgt)
-
+		tgt, err := e.fetchFile(u, fn)
 		if err != nil {
-			// let's download data
-			os.MkdirAll(cacheDir, 0755)
-			err = doDownload(tgt, cacheUrl)
-			if err != nil {
-				needUpload = true
-				// retry
-				err = doDownload(tgt, u)
-			}
-			if err != nil {
-				return err
-			}
-			st, err = os.Stat(tgt)
-			if err != nil {
-				return err
-			}
-		}
-
-		// check checksums
-		log.Printf("Checking %s", fn)
-
-		cksum := hashFile(tgt)
-		if cksum == nil {
-			return errors.New("failed to compute hash")
-		}
-
-		updated := false
-		info, ok := e.config.meta.Files[fn]
-		if !ok {
-			updated = true
-			info = &buildFile{
-				Size:   st.Size(),
-				Added:  time.Now(),
-				Hashes: make(map[string]string),
-			}
-			if e.config.meta.Files == nil {
-				e.config.meta.Files = make(map[string]*buildFile)
-			}
-			e.config.meta.Files[fn] = info
-		} else {
-			if info.Size != st.Size() {
-				return fmt.Errorf("invalid file size for %s", fn)
-			}
-			if info.Added.IsZero() {
-				updated = true
-				info.Added = time.Now()
-			}
-		}
-
-		for hashName, value := range cksum {
-			if goodval, ok := info.Hashes[hashName]; ok {
-				if goodval != value {
-					return fmt.Errorf("failed checking %s: %s hash value fail", fn, hashName)
-				}
-			} else {
-				info.Hashes[hashName] = value
-				updated = true
-			}
-		}
-
-		if updated {
-			e.config.Save()
-		}
-		if needUpload {
-			// upload file to the cache
-			c := exec.Command("aws", "s3", "cp", tgt, "s3://azusa-pkg/src/main/"+e.category+"/"+e.name+"/"+fn)
-			c.Stdout = os.Stdout
-			c.Stderr = os.Stderr
-			if err := c.Run(); err != nil {
-				log.Printf("Warning: failed to upload to S3 cache: %s", err)
-			}
+			return err
 		}
 
 		// copy file to work
@@ -160,10 +85,102 @@ func (e *buildEnv) download() error {
 	return nil
 }
 
-func doDownload(tgt string, srcurl string) error {
+// fetchFile ensures fn is in the local download cache, fetching it from our
+// mirror or from u if needed, and checks it against the hashes recorded in
+// metadata.yaml. It returns the path of the file in the cache.
+func (e *buildEnv) fetchFile(u, fn string) (string, error) {
+	cacheDir := "/tmp/apkg-data"
+
+	tgt := filepath.Join(cacheDir, fn)
+	cacheUrl := "https://pkg.azusa.jp/src/main/" + e.category + "/" + e.name + "/" + fn
+	needUpload := false
+
+	st, err := os.Stat(tgt)
+
+	if err != nil {
+		// let's download data
+		os.MkdirAll(filepath.Dir(tgt), 0755)
+		err = doDownload(e.ctx, tgt, cacheUrl)
+		if err != nil {
+			needUpload = true
+			// retry
+			err = doDownload(e.ctx, tgt, u)
+		}
+		if err != nil {
+			return "", err
+		}
+		st, err = os.Stat(tgt)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// check checksums
+	log.Printf("Checking %s", fn)
+
+	cksum := hashFile(tgt)
+	if cksum == nil {
+		return "", errors.New("failed to compute hash")
+	}
+
+	updated := false
+	info, ok := e.config.meta.Files[fn]
+	if !ok {
+		updated = true
+		info = &buildFile{
+			Size:   st.Size(),
+			Added:  time.Now(),
+			Hashes: make(map[string]string),
+		}
+		if e.config.meta.Files == nil {
+			e.config.meta.Files = make(map[string]*buildFile)
+		}
+		e.config.meta.Files[fn] = info
+	} else {
+		if info.Size != st.Size() {
+			return "", fmt.Errorf("invalid file size for %s", fn)
+		}
+		if info.Added.IsZero() {
+			updated = true
+			info.Added = time.Now()
+		}
+	}
+
+	for hashName, value := range cksum {
+		if goodval, ok := info.Hashes[hashName]; ok {
+			if goodval != value {
+				return "", fmt.Errorf("failed checking %s: %s hash value fail", fn, hashName)
+			}
+		} else {
+			info.Hashes[hashName] = value
+			updated = true
+		}
+	}
+
+	if updated {
+		e.config.Save()
+	}
+	if needUpload {
+		// upload file to the cache
+		c := exec.CommandContext(e.ctx, "aws", "s3", "cp", tgt, "s3://azusa-pkg/src/main/"+e.category+"/"+e.name+"/"+fn)
+		c.Stdout = consoleStdout()
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			log.Printf("Warning: failed to upload to S3 cache: %s", err)
+		}
+	}
+
+	return tgt, nil
+}
+
+func doDownload(ctx context.Context, tgt string, srcurl string) error {
 	log.Printf("Attempting to download: %s", srcurl)
 	// download url to tgt
-	resp, err := http.Get(srcurl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srcurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -177,7 +194,15 @@ func doDownload(tgt string, srcurl string) error {
 		return err
 	}
 	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
+
+	var w io.Writer = out
+	if events != nil {
+		p := &progressWriter{url: srcurl, total: resp.ContentLength}
+		defer p.done()
+		w = io.MultiWriter(out, p)
+	}
+
+	_, err = io.Copy(w, resp.Body)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventStream writes build events as one JSON object per line, so wrappers
+// can follow the progress of a build without parsing log lines
+type eventStream struct {
+	lk  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	fd  int
+}
+
+type buildEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"` // build_start, build_end, phase_start, phase_end, command_start, command_end, download, patch, package, error
+	Package    string    `json:"package,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Arch       string    `json:"arch,omitempty"`
+	Phase      string    `json:"phase,omitempty"`
+	Dir        string    `json:"dir,omitempty"`
+	Args       []string  `json:"args,omitempty"`
+	ExitStatus *int      `json:"exit_status,omitempty"`
+	Duration   float64   `json:"duration,omitempty"` // in seconds
+	URL        string    `json:"url,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Total      int64     `json:"total,omitempty"` // -1 if unknown
+	Done       bool      `json:"done,omitempty"`
+	Patch      string    `json:"patch,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Success    *bool     `json:"success,omitempty"` // set on phase_end and build_end, even if false
+	Error      string    `json:"error,omitempty"`
+}
+
+// events is nil unless -events is used
+var events *eventStream
+
+func openEvents() error {
+	switch *buildEvents {
+	case "":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("unsupported events format %s", *buildEvents)
+	}
+
+	fd := *buildEventsFd
+	w := os.Stdout
+	if fd != 1 {
+		w = os.NewFile(uintptr(fd), "events")
+		if w == nil {
+			return fmt.Errorf("invalid events file descriptor %d", fd)
+		}
+		if _, err := w.Stat(); err != nil {
+			return fmt.Errorf("events file descriptor %d: %w", fd, err)
+		}
+	}
+
+	events = &eventStream{w: w, enc: json.NewEncoder(w), fd: fd}
+	return nil
+}
+
+func (s *eventStream) emit(ev *buildEvent) {
+	if s == nil {
+		return
+	}
+	ev.Time = time.Now()
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.enc.Encode(ev)
+}
+
+// consoleStdout returns where the output of commands should go, which is
+// stderr if stdout is used by the event stream
+func consoleStdout() io.Writer {
+	if events != nil && events.fd == 1 {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// progressWriter emits download events as data is written, at most twice a
+// second
+type progressWriter struct {
+	url   string
+	n     int64
+	total int64
+	last  time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	if time.Since(p.last) >= 500*time.Millisecond {
+		p.last = time.Now()
+		events.emit(&buildEvent{Type: "download", URL: p.url, Bytes: p.n, Total: p.total})
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) done() {
+	events.emit(&buildEvent{Type: "download", URL: p.url, Bytes: p.n, Total: p.total, Done: true})
+}
@@ -2,12 +2,12 @@ module github.com/AzusaOS/apkg-build
 
 go 1.18
 
-require gopkg.in/yaml.v3 v3.0.1
-
 require (
-	github.com/kr/fs v0.1.0 // indirect
-	github.com/pkg/sftp v1.13.4 // indirect
-	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
-	mvdan.cc/sh/v3 v3.5.1 // indirect
+	github.com/pkg/sftp v1.13.4
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	gopkg.in/yaml.v3 v3.0.1
+	mvdan.cc/sh/v3 v3.5.1
 )
+
+require github.com/kr/fs v0.1.0 // indirect
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildGo() (*engineSteps, error) {
+	var err error
+
+	goRoot := e.goRoot()
+
+	// packages to build & install, defaults to everything
+	goPkgs := []string{"./..."}
+	if v := e.getVar("GO_PACKAGES"); v != "" {
+		goPkgs = strings.Fields(v)
+	}
+
+	goFlags := []string{"-trimpath", "-buildvcs=false"}
+	for _, arg := range e.i.Arguments {
+		arg, err = shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		goFlags = append(goFlags, arg)
+	}
+
+	goPath := "/pkg/main/dev-lang.go.core/bin"
+	if !strings.HasPrefix(e.getVar("PATH"), goPath+":") {
+		e.vars["PATH"] = goPath + ":" + e.getVar("PATH")
+	}
+	e.vars["GOOS"] = e.os
+	e.vars["GOARCH"] = e.arch
+	e.vars["GOTOOLCHAIN"] = "local"
+	e.vars["GOPATH"] = filepath.Join(e.temp, "gopath")
+	e.vars["GOMODCACHE"] = filepath.Join(e.temp, "gomodcache")
+	e.vars["GOCACHE"] = filepath.Join(e.temp, "gocache")
+	e.vars["GOPROXY"] = "file://" + filepath.Join(e.temp, "goproxy")
+	e.vars["GOSUMDB"] = "off" // go.sum is still checked
+	e.vars["CGO_CPPFLAGS"] = e.getVar("CPPFLAGS")
+	e.vars["CGO_LDFLAGS"] = e.getVar("LDFLAGS")
+
+	// go install refuses GOBIN when cross compiling, go build -o dir/ does the same job
+	binDir := filepath.Join(e.dist, e.getDir("core"), "bin")
+
+	buildDir := goRoot
+
+	// flags are passed as arguments rather than GOFLAGS, which can't hold
+	// values containing spaces (eg. -ldflags=-s -w)
+	goCmd := func(cmd string, args ...string) []string {
+		res := append([]string{"go", cmd}, goFlags...)
+		res = append(res, args...)
+		return append(res, goPkgs...)
+	}
+
+	install := func() error {
+		err := e.backend.MkdirAll(binDir, 0755)
+		if err != nil {
+			return err
+		}
+		return e.runIn(buildDir, goCmd("build", "-o", binDir+"/")...)
+	}
+
+	return &engineSteps{
+		dir: buildDir,
+		compile: func() error {
+			return e.runIn(buildDir, goCmd("build")...)
+		},
+		test: func() error {
+			return e.runIn(buildDir, goCmd("test")...)
+		},
+		install: install,
+	}, nil
+}
+
+// goRoot returns the directory containing go.mod, $S unless overridden via
+// GO_ROOT
+func (e *buildEnv) goRoot() string {
+	if v := e.getVar("GO_ROOT"); v != "" {
+		return v
+	}
+	return e.src
+}
+
+// goDownload downloads all the modules listed in go.sum and makes them
+// available to the go command through the GOPROXY in $T/goproxy
+func (e *buildEnv) goDownload() error {
+	goRoot := e.goRoot()
+	if _, err := e.backend.Stat(filepath.Join(goRoot, "vendor", "modules.txt")); err == nil {
+		// dependencies are already vendored in the source
+		log.Printf("go: using vendor directory")
+		return nil
+	}
+
+	sum, err := e.backend.ReadFile(filepath.Join(goRoot, "go.sum"))
+	if err != nil {
+		// no dependencies
+		return nil
+	}
+
+	proxyDir := filepath.Join(e.temp, "goproxy")
+	count := 0
+
+	for _, f := range parseGoSum(sum) {
+		modPath := goModEscape(f[0])
+		modVer := goModEscape(f[1])
+		dir := filepath.Join(proxyDir, modPath, "@v")
+
+		err = e.backend.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+
+		fn := filepath.Join("gomod", modPath, "@v", modVer+f[2])
+		u := "https://proxy.golang.org/" + modPath + "/@v/" + modVer + f[2]
+
+		tgt, err := e.fetchFile(u, fn)
+		if err != nil {
+			return err
+		}
+
+		err = e.backend.PutFile(tgt, filepath.Join(dir, modVer+f[2]))
+		if err != nil {
+			return err
+		}
+
+		if f[2] == ".mod" {
+			info := fmt.Sprintf(`{"Version":"%s"}`, f[1])
+			err = e.backend.WriteFile(filepath.Join(dir, modVer+".info"), []byte(info), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		count++
+	}
+
+	log.Printf("go: fetched %d module files", count)
+
+	return nil
+}
+
+// parseGoSum returns the list of files (module, version, extension) needed
+// from the module proxy to satisfy go.sum
+func parseGoSum(data []byte) [][3]string {
+	var res [][3]string
+	seen := make(map[string]bool)
+
+	add := func(mod, ver, ext string) {
+		k := mod + "@" + ver + ext
+		if seen[k] {
+			return
+		}
+		seen[k] = true
+		res = append(res, [3]string{mod, ver, ext})
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 3 {
+			continue
+		}
+		if strings.HasSuffix(f[1], "/go.mod") {
+			add(f[0], strings.TrimSuffix(f[1], "/go.mod"), ".mod")
+			continue
+		}
+		// the go command will want both the go.mod and the zip file
+		add(f[0], f[1], ".mod")
+		add(f[0], f[1], ".zip")
+	}
+
+	return res
+}
+
+// goModEscape escapes a module path or version the same way the module proxy
+// protocol does, replacing uppercase letters with ! followed by the lowercase letter
+func goModEscape(s string) string {
+	buf := &strings.Builder{}
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			buf.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGoSum(t *testing.T) {
+	tests := []struct {
+		name string
+		sum  string
+		want [][3]string
+	}{
+		{
+			name: "empty",
+			sum:  "",
+			want: nil,
+		},
+		{
+			name: "module and go.mod",
+			sum: `golang.org/x/sys v0.15.0 h1:h48lPFYpsTvQJZF4EKyI4aLHaev3CxivZmv7yZig9pc=
+golang.org/x/sys v0.15.0/go.mod h1:/VUhepiaJMQUp4+oa/7Zr1D23ma6VTLIYjOOTFZPUcA=
+`,
+			want: [][3]string{
+				{"golang.org/x/sys", "v0.15.0", ".mod"},
+				{"golang.org/x/sys", "v0.15.0", ".zip"},
+			},
+		},
+		{
+			name: "go.mod only",
+			sum: `github.com/BurntSushi/toml v1.3.2/go.mod h1:CxXYINrC8qIiEnFrOxCa7Jy5BFHlXnUU2pbicEuybxQ=
+`,
+			want: [][3]string{
+				{"github.com/BurntSushi/toml", "v1.3.2", ".mod"},
+			},
+		},
+		{
+			name: "invalid lines",
+			sum: `
+not a go.sum line
+example.com/a v1.0.0 h1:x= extra
+`,
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got := parseGoSum([]byte(tt.sum))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseGoSum() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGoModEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"golang.org/x/sys", "golang.org/x/sys"},
+		{"github.com/BurntSushi/toml", "github.com/!burnt!sushi/toml"},
+		{"v1.0.0-RC1", "v1.0.0-!r!c1"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := goModEscape(tt.in); got != tt.want {
+			t.Errorf("goModEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -8,11 +10,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-type localBackend struct{}
+// netInitArg is the first argument apkg-build is re-executed with to set up
+// the network namespace of a command run without network
+const netInitArg = "net-init"
+
+type localBackend struct {
+	noNetwork bool
+}
 
 func NewLocal() Backend {
 	return &localBackend{}
@@ -109,11 +119,86 @@ func (b *localBackend) GetFile(src, tgt string) error {
 	return cloneFile(src, tgt)
 }
 
-func (b *localBackend) RunEnv(dir string, args []string, env []string, stdout, stderr io.Writer) error {
+func (b *localBackend) RunEnv(ctx context.Context, dir string, args []string, env []string, stdout, stderr io.Writer) error {
 	c := exec.Command(args[0], args[1:]...)
+	if b.noNetwork {
+		// netInit brings up lo before running the command
+		c = exec.Command("/proc/self/exe", append([]string{netInitArg}, args...)...)
+		c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+		if os.Getuid() != 0 {
+			// a user namespace is needed to create the network namespace
+			c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+			c.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+			c.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+			// needed to bring up lo, dropped by netInit before running the command
+			c.SysProcAttr.AmbientCaps = []uintptr{unix.CAP_NET_ADMIN}
+		}
+	}
 	c.Dir = dir
 	c.Env = env
 
+	return runCmd(ctx, c, stdout, stderr)
+}
+
+// SetNetwork runs the following commands in a new network namespace, without
+// any interface besides the loopback if enabled is false. A test command is
+// run first, as namespaces may not be allowed.
+func (b *localBackend) SetNetwork(enabled bool) error {
+	if enabled || b.noNetwork {
+		b.noNetwork = !enabled
+		return nil
+	}
+	b.noNetwork = true
+	err := b.RunEnv(context.Background(), "/", []string{"/bin/true"}, nil, io.Discard, nil)
+	if err != nil {
+		b.noNetwork = false
+		return fmt.Errorf("failed to create a network namespace: %w", err)
+	}
+	return nil
+}
+
+// netInit runs inside the network namespace created for a command by the
+// local backend. It brings up lo, then runs the command.
+func netInit(args []string) {
+	// capabilities are per thread
+	runtime.LockOSThread()
+
+	err := netSetup(args)
+
+	// only reached if something failed
+	fmt.Fprintf(os.Stderr, "net-init: %s\n", err)
+	os.Exit(127)
+}
+
+func netSetup(args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing command")
+	}
+
+	err := loopbackUp()
+	if err != nil {
+		return fmt.Errorf("while bringing up lo: %w", err)
+	}
+	err = dropInheritableCaps()
+	if err != nil {
+		return fmt.Errorf("while dropping capabilities: %w", err)
+	}
+
+	bin, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return unix.Exec(bin, args, os.Environ())
+}
+
+// runCmd runs c in its own process group, and kills the whole group if ctx is
+// done
+func runCmd(ctx context.Context, c *exec.Cmd, stdout, stderr io.Writer) error {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+
 	if stdout == nil {
 		stdout = os.Stdout
 	}
@@ -124,6 +209,37 @@ func (b *localBackend) RunEnv(dir string, args []string, env []string, stdout, s
 	c.Stdout = stdout
 	c.Stderr = stderr
 
+	err := c.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			unix.Kill(-c.Process.Pid, unix.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = c.Wait()
+	close(done)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (b *localBackend) Shell(dir string, env []string) error {
+	// our own terminal is used as is
+	c := exec.Command("/bin/bash", "-i")
+	c.Dir = dir
+	c.Env = env
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
 	return c.Run()
 }
 
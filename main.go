@@ -7,6 +7,15 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		// we are running a command in the sandbox
+		sandboxInit(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == netInitArg {
+		// we are running a command without network
+		netInit(os.Args[2:])
+	}
+
 	// Check os.Args
 	log.Printf("apkg-build running...")
 
@@ -26,15 +35,31 @@ func main() {
 		log.Printf("Updating repository...")
 		updateRepo()
 	case "build":
+		buildFlags.Parse(args[1:])
+		if buildFlags.NArg() != 1 {
+			log.Printf("Usage: %s build [-test] [-from phase] [-keep] [-shell-on-failure] package", os.Args[0])
+			os.Exit(1)
+		}
+		pkg := loadPackage(buildFlags.Arg(0))
+		if pkg == nil {
+			os.Exit(1)
+		}
+		pkg.build()
+	case "shell":
 		if len(args) != 2 {
-			log.Printf("Usage: %s build package", os.Args[0])
+			log.Printf("Usage: %s shell package", os.Args[0])
 			os.Exit(1)
 		}
 		pkg := loadPackage(args[1])
 		if pkg == nil {
 			os.Exit(1)
 		}
-		pkg.build()
+		pkg.shell()
+	case "vm":
+		if err := vmCommand(args[1:]); err != nil {
+			log.Printf("%s", err)
+			os.Exit(1)
+		}
 	case "convert":
 		if len(args) == 1 {
 			// Convert all packages
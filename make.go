@@ -0,0 +1,45 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildMake() (*engineSteps, error) {
+	// allow override of makeRoot via MAKE_ROOT
+	makeRoot := e.src
+	if v := e.getVar("MAKE_ROOT"); v != "" {
+		makeRoot = v
+	}
+
+	// the usual variables understood by plain Makefiles
+	makeVars := []string{
+		"PREFIX=" + e.getDir("core"),
+		"LIBDIR=" + e.getDir("libs") + "/lib" + e.libsuffix,
+		"INCLUDEDIR=" + e.getDir("dev") + "/include",
+		"MANDIR=" + e.getDir("doc") + "/man",
+	}
+
+	// Process custom arguments from build.yaml, passed as make variables
+	for _, arg := range e.i.Arguments {
+		arg, err := shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		makeVars = append(makeVars, arg)
+	}
+
+	buildDir := makeRoot
+
+	return &engineSteps{
+		dir: buildDir,
+		compile: func() error {
+			return e.runIn(buildDir, append([]string{"make", "-j" + strconv.Itoa(runtime.NumCPU())}, makeVars...)...)
+		},
+		install: func() error {
+			return e.runIn(buildDir, append([]string{"make", "install", "DESTDIR=" + e.dist}, makeVars...)...)
+		},
+	}, nil
+}
@@ -4,7 +4,7 @@ import (
 	"mvdan.cc/sh/v3/shell"
 )
 
-func (e *buildEnv) buildMeson() error {
+func (e *buildEnv) buildMeson() (*engineSteps, error) {
 	// build custom rules (gentoo inspired)
 
 	// allow override of mesonRoot via MESON_ROOT
@@ -27,60 +27,28 @@ func (e *buildEnv) buildMeson() error {
 	for _, arg := range e.i.Arguments {
 		arg, err := shell.Expand(arg, e.getVar)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		mesonOpts = append(mesonOpts, arg)
 	}
 
 	buildDir := e.temp
 
-	err := e.runManyIn(buildDir, e.i.ConfigurePre)
-	if err != nil {
-		return err
-	}
-
-	err = e.runIn(buildDir, mesonOpts...)
-	if err != nil {
-		return err
-	}
-
-	err = e.runManyIn(buildDir, e.i.ConfigurePost)
-	if err != nil {
-		return err
-	}
-
-	err = e.runManyIn(buildDir, e.i.CompilePre)
-	if err != nil {
-		return err
-	}
-
-	err = e.runIn(buildDir, "ninja")
-	if err != nil {
-		return err
-	}
-
-	err = e.runManyIn(buildDir, e.i.CompilePost)
-	if err != nil {
-		return err
-	}
-
-	// let meson know of our DESTDIR
-	e.vars["DESTDIR"] = e.dist
-
-	err = e.runManyIn(buildDir, e.i.InstallPre)
-	if err != nil {
-		return err
-	}
-
-	err = e.runIn(buildDir, "ninja", "install")
-	if err != nil {
-		return err
-	}
-
-	err = e.runManyIn(buildDir, e.i.InstallPost)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return &engineSteps{
+		dir: buildDir,
+		configure: func() error {
+			return e.runIn(buildDir, mesonOpts...)
+		},
+		compile: func() error {
+			return e.runIn(buildDir, "ninja")
+		},
+		test: func() error {
+			return e.runIn(buildDir, "meson", "test", "--print-errorlogs")
+		},
+		install: func() error {
+			return e.runIn(buildDir, "ninja", "install")
+		},
+		// let meson know of our DESTDIR
+		installVars: map[string]string{"DESTDIR": e.dist},
+	}, nil
 }
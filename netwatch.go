@@ -0,0 +1,38 @@
+package main
+
+import "strings"
+
+// errors commands typically show when they can't access the network
+var netErrMessages = []string{
+	"network is unreachable",
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"name or service not known",
+	"no address associated with hostname",
+	"failed to lookup address",
+}
+
+// netErrWatcher looks for network errors in the output of a command
+type netErrWatcher struct {
+	tail  string // end of the previous write, in case a message is split
+	found bool
+}
+
+func (w *netErrWatcher) Write(b []byte) (int, error) {
+	if w.found {
+		return len(b), nil
+	}
+
+	s := w.tail + strings.ToLower(string(b))
+	for _, msg := range netErrMessages {
+		if strings.Contains(s, msg) {
+			w.found = true
+			break
+		}
+	}
+	if len(s) > 64 {
+		s = s[len(s)-64:]
+	}
+	w.tail = s
+	return len(b), nil
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,6 +18,19 @@ import (
 var (
 	buildVersion = flag.String("version", "", "specify version to build")
 	buildArch    = flag.String("arch", runtime.GOARCH, "specify arch")
+	buildBackend = flag.String("backend", "", "build backend: local, qemu, sandbox, rootfs or qemu-user, or a list of arch=backend (default: qemu if available, local otherwise)")
+	buildBuilder = flag.String("builder", "", "run the build on a remote builder from the configuration file")
+	configFile   = flag.String("config", "", "configuration file (default: apkg-build/config.yaml in the user config directory)")
+
+	// flags of the build command
+	buildFlags = flag.NewFlagSet("build", flag.ExitOnError)
+	buildTest  = buildFlags.Bool("test", false, "run the package test suite after compiling")
+	buildFrom  = buildFlags.String("from", "", "resume a failed build from the given phase (download, patch, import, configure, compile, test, install, fixelf, organize, archive)")
+	buildKeep  = buildFlags.Bool("keep", false, "keep the build directory after a successful build")
+
+	buildShellOnFailure = buildFlags.Bool("shell-on-failure", false, "open an interactive shell in the build environment if a phase fails")
+	buildEvents         = buildFlags.String("events", "", "emit build events in the given format (json)")
+	buildEventsFd       = buildFlags.Int("events-fd", 1, "file descriptor to write events to")
 )
 
 type pkg struct {
@@ -214,6 +230,47 @@ func (p *pkg) readShellConfig() (*buildConfig, error) {
 func (p *pkg) build() {
 	log.Printf("Build %s", p.fn)
 
+	if err := openEvents(); err != nil {
+		log.Printf("Failed to open event stream: %s", err)
+		os.Exit(1)
+	}
+
+	e := p.newBuildEnv(*buildFrom != "")
+
+	// the first interrupt stops the build cleanly, a second one kills apkg-build
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Printf("Interrupted, stopping build (interrupt again to abort)")
+		signal.Stop(sig)
+		cancel()
+	}()
+	e.ctx = ctx
+
+	// let's check versions unless forced
+	err := e.build(p)
+	if err != nil {
+		log.Printf("build failed: %s", err)
+		os.Exit(1)
+	}
+}
+
+func (p *pkg) shell() {
+	e := p.newBuildEnv(true)
+
+	err := e.shell()
+	if err != nil {
+		log.Printf("shell failed: %s", err)
+		os.Exit(1)
+	}
+}
+
+// newBuildEnv prepares the build environment of p. resume is set when
+// continuing a previous build, which needs the backend holding its directory.
+func (p *pkg) newBuildEnv(resume bool) *buildEnv {
 	// parse config
 	c, err := p.readBuildConfig()
 	if err != nil {
@@ -232,21 +289,17 @@ func (p *pkg) build() {
 	}
 
 	e := &buildEnv{
+		ctx:     context.Background(),
 		pkg:     p,
 		config:  c,
 		version: version,
 		os:      runtime.GOOS,
 		arch:    *buildArch,
+		resume:  resume,
 	}
 	if err := e.initVars(); err != nil {
 		log.Printf("Failed to initialize build environment: %s", err)
 		os.Exit(1)
 	}
-
-	// let's check versions unless forced
-	err = e.build(p)
-	if err != nil {
-		log.Printf("build failed: %s", err)
-		os.Exit(1)
-	}
+	return e
 }
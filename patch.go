@@ -34,6 +34,7 @@ func (e *buildEnv) applyPatches() error {
 			// attempt to apply patch
 			err = e.runIn(e.src, "patch", fmt.Sprintf("-p%d", plevel), "-Nt", "-i", fn)
 			if err == nil {
+				events.emit(&buildEvent{Type: "patch", Patch: patch})
 				break
 			}
 		}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildPerl() (*engineSteps, error) {
+	var err error
+
+	// allow override of perlRoot via PERL_ROOT
+	perlRoot := e.src
+	if v := e.getVar("PERL_ROOT"); v != "" {
+		perlRoot = v
+	}
+
+	// perl modules go to libs, scripts to core and man pages to doc
+	libDir := e.getDir("libs") + "/lib" + e.libsuffix + "/perl5/vendor_perl"
+	binDir := e.getDir("core") + "/bin"
+	man1Dir := e.getDir("doc") + "/man/man1"
+	man3Dir := e.getDir("doc") + "/man/man3"
+
+	var configOpts, compileOpts, testOpts, installOpts []string
+
+	if _, err = e.backend.Stat(filepath.Join(perlRoot, "Build.PL")); err == nil {
+		// Module::Build
+		configOpts = []string{
+			"perl", "Build.PL",
+			"--installdirs", "vendor",
+			"--install_path", "lib=" + libDir,
+			"--install_path", "arch=" + libDir,
+			"--install_path", "bin=" + binDir,
+			"--install_path", "script=" + binDir,
+			"--install_path", "bindoc=" + man1Dir,
+			"--install_path", "libdoc=" + man3Dir,
+		}
+		compileOpts = []string{"./Build"}
+		testOpts = []string{"./Build", "test"}
+		installOpts = []string{"./Build", "install", "--destdir", e.dist}
+	} else if _, err = e.backend.Stat(filepath.Join(perlRoot, "Makefile.PL")); err == nil {
+		// ExtUtils::MakeMaker
+		configOpts = []string{
+			"perl", "Makefile.PL",
+			"INSTALLDIRS=vendor",
+			"INSTALLVENDORLIB=" + libDir,
+			"INSTALLVENDORARCH=" + libDir,
+			"INSTALLVENDORBIN=" + binDir,
+			"INSTALLVENDORSCRIPT=" + binDir,
+			"INSTALLVENDORMAN1DIR=" + man1Dir,
+			"INSTALLVENDORMAN3DIR=" + man3Dir,
+		}
+		compileOpts = []string{"make", "-j" + strconv.Itoa(runtime.NumCPU())}
+		testOpts = []string{"make", "test"}
+		installOpts = []string{"make", "install", "DESTDIR=" + e.dist}
+	} else {
+		return nil, fmt.Errorf("perl: could not find Build.PL or Makefile.PL in %s", perlRoot)
+	}
+
+	for _, arg := range e.i.Arguments {
+		arg, err = shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		configOpts = append(configOpts, arg)
+	}
+
+	// perl modules are built in tree
+	buildDir := perlRoot
+
+	// do not ask questions during configure
+	e.vars["PERL_MM_USE_DEFAULT"] = "1"
+
+	return &engineSteps{
+		dir: buildDir,
+		configure: func() error {
+			return e.runIn(buildDir, configOpts...)
+		},
+		compile: func() error {
+			return e.runIn(buildDir, compileOpts...)
+		},
+		test: func() error {
+			return e.runIn(buildDir, testOpts...)
+		},
+		install: func() error {
+			return e.runIn(buildDir, installOpts...)
+		},
+	}, nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// build phases, in the order they run
+const (
+	phaseDownload  = "download"
+	phasePatch     = "patch"
+	phaseImport    = "import"
+	phaseConfigure = "configure"
+	phaseCompile   = "compile"
+	phaseTest      = "test"
+	phaseInstall   = "install"
+	phaseFixElf    = "fixelf"
+	phaseOrganize  = "organize"
+	phaseArchive   = "archive"
+)
+
+var buildPhases = []string{
+	phaseDownload,
+	phasePatch,
+	phaseImport,
+	phaseConfigure,
+	phaseCompile,
+	phaseTest,
+	phaseInstall,
+	phaseFixElf,
+	phaseOrganize,
+	phaseArchive,
+}
+
+// engineSteps is what a build engine provides to the pipeline: the directory
+// it builds in, and the commands to run for each of the engine phases. A nil
+// step only runs the hooks of the phase.
+type engineSteps struct {
+	dir       string
+	configure func() error
+	compile   func() error
+	test      func() error
+	install   func() error
+
+	// configurePostDir is where configure_post runs, dir if empty
+	configurePostDir string
+	// installVars are set in the environment from the install phase on
+	installVars map[string]string
+}
+
+var buildEngines = map[string]func(e *buildEnv) (*engineSteps, error){
+	"autoconf": (*buildEnv).buildAutoconf,
+	"cmake":    (*buildEnv).buildCmake,
+	"qmake":    (*buildEnv).buildQmake,
+	"meson":    (*buildEnv).buildMeson,
+	"scons":    (*buildEnv).buildScons,
+	"waf":      (*buildEnv).buildWaf,
+	"make":     (*buildEnv).buildMake,
+	"python":   (*buildEnv).buildPython,
+	"perl":     (*buildEnv).buildPerl,
+	"cargo":    (*buildEnv).buildCargo,
+	"go":       (*buildEnv).buildGo,
+	"none":     (*buildEnv).buildNone,
+}
+
+// engineDownloads fetch what an engine needs besides the sources, such as the
+// dependencies listed in a lock file. They run at the end of the download
+// phase so that configure and the following phases can run offline.
+var engineDownloads = map[string]func(e *buildEnv) error{
+	"cargo": (*buildEnv).cargoDownload,
+	"go":    (*buildEnv).goDownload,
+}
+
+func isPhase(name string) bool {
+	for _, p := range buildPhases {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *engineSteps) step(phase string) func() error {
+	switch phase {
+	case phaseConfigure:
+		return s.configure
+	case phaseCompile:
+		return s.compile
+	case phaseTest:
+		return s.test
+	case phaseInstall:
+		return s.install
+	}
+	return nil
+}
+
+// hooks returns the hooks to run before and after the given engine phase
+func (i *buildInstructions) hooks(phase string) (pre, post []string) {
+	switch phase {
+	case phaseConfigure:
+		return i.ConfigurePre, i.ConfigurePost
+	case phaseCompile:
+		return i.CompilePre, i.CompilePost
+	case phaseTest:
+		return i.TestPre, i.TestPost
+	case phaseInstall:
+		return i.InstallPre, i.InstallPost
+	}
+	return nil, nil
+}
+
+func (i *buildInstructions) hasOption(opt string) bool {
+	for _, o := range i.Options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// runPhase runs a single phase of the build
+func (e *buildEnv) runPhase(name string) error {
+	log.Printf("phase %s: starting", name)
+	start := time.Now()
+	e.log.phase = name
+	events.emit(&buildEvent{Type: "phase_start", Phase: name})
+
+	parent := e.ctx
+	timeout := e.i.Timeouts[name]
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+		e.ctx = ctx
+		defer func() {
+			e.ctx = parent
+		}()
+	}
+
+	err := e.setNetwork(name)
+	if err == nil {
+		err = e.doPhase(name)
+	}
+	switch {
+	case err == nil:
+	case parent.Err() != nil:
+		err = errors.New("interrupted")
+	case e.ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("timed out after %s (see timeouts in build.yaml)", timeout)
+	}
+	e.log.phaseDone(name, time.Since(start), err)
+	ok := err == nil
+	ev := &buildEvent{Type: "phase_end", Phase: name, Duration: time.Since(start).Seconds(), Success: &ok}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	events.emit(ev)
+	if err != nil {
+		log.Printf("phase %s: failed after %s", name, time.Since(start).Round(time.Millisecond))
+		e.state.Failed = name
+		e.state.Dir = e.phaseDir(name)
+		if err := e.saveState(); err != nil {
+			log.Printf("WARNING: failed to save build state: %s", err)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	log.Printf("phase %s: done in %s", name, time.Since(start).Round(time.Millisecond))
+	e.state.Failed = ""
+	e.state.Dir = ""
+	e.state.Done = append(e.state.Done, name)
+	if err := e.saveState(); err != nil {
+		log.Printf("WARNING: failed to save build state: %s", err)
+	}
+	return nil
+}
+
+// setNetwork enables network access for the download phase, and disables it
+// for all others unless the recipe has the network option
+func (e *buildEnv) setNetwork(phase string) error {
+	offline := phase != phaseDownload && !e.i.hasOption("network")
+	if offline == e.offline {
+		return nil
+	}
+
+	err := e.backend.SetNetwork(!offline)
+	if err != nil {
+		if offline {
+			return fmt.Errorf("failed to disable network access (add the network option to build.yaml to build with network access): %w", err)
+		}
+		return fmt.Errorf("failed to enable network access: %w", err)
+	}
+	e.offline = offline
+	if offline {
+		log.Printf("network access disabled")
+	} else {
+		log.Printf("network access enabled")
+	}
+	return nil
+}
+
+// phaseDir returns the directory a phase works in
+func (e *buildEnv) phaseDir(name string) string {
+	switch name {
+	case phaseDownload:
+		return e.workdir
+	case phaseConfigure, phaseCompile, phaseTest, phaseInstall:
+		if e.steps != nil {
+			return e.steps.dir
+		}
+	case phaseFixElf, phaseOrganize, phaseArchive:
+		return e.dist
+	}
+	if e.src != "" {
+		return e.src
+	}
+	return e.workdir
+}
+
+func (e *buildEnv) doPhase(name string) error {
+	switch name {
+	case phaseDownload:
+		if err := e.download(); err != nil {
+			return err
+		}
+		return e.downloadEngine()
+	case phasePatch:
+		return e.applyPatches()
+	case phaseImport:
+		if err := e.doImport(); err != nil {
+			return err
+		}
+		// we call applyEnv a second time because in some cases we use ${S} which is defined by e.download(), or we use $CPPFLAGS defined by import
+		return e.applyEnv()
+	case phaseFixElf:
+		return e.fixElf()
+	case phaseOrganize:
+		return e.organize()
+	case phaseArchive:
+		return e.archive()
+	case phaseConfigure, phaseCompile, phaseTest, phaseInstall:
+		return e.runEnginePhase(name)
+	}
+	return fmt.Errorf("unknown phase %s", name)
+}
+
+// runEnginePhase runs the engine step for phase, surrounded by its hooks. The
+// engine is only set up after configure_pre, so these hooks can generate the
+// files it looks for.
+func (e *buildEnv) runEnginePhase(name string) error {
+	if name == phaseTest {
+		if !*buildTest {
+			log.Printf("phase %s: skipped (use -test to run tests)", name)
+			return nil
+		}
+		if e.i.hasOption("no_test") {
+			log.Printf("phase %s: skipped (no_test)", name)
+			return nil
+		}
+	}
+
+	pre, post := e.i.hooks(name)
+
+	if name == phaseConfigure {
+		err := e.runManyIn(e.configurePreDir(), pre)
+		if err != nil {
+			return err
+		}
+		pre = nil
+	}
+
+	if e.steps == nil {
+		if err := e.initEngine(); err != nil {
+			return err
+		}
+	}
+
+	if name == phaseInstall {
+		for k, v := range e.steps.installVars {
+			e.vars[k] = v
+		}
+	}
+
+	err := e.runManyIn(e.steps.dir, pre)
+	if err != nil {
+		return err
+	}
+
+	if step := e.steps.step(name); step != nil {
+		err = step()
+		if err != nil && name == phaseTest {
+			if !e.i.hasOption("test_allow_failure") {
+				return fmt.Errorf("test suite failed: %w", err)
+			}
+			log.Printf("WARNING: test suite failed: %s (ignored because of test_allow_failure)", err)
+			e.testErr = err
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	postDir := e.steps.dir
+	if name == phaseConfigure && e.steps.configurePostDir != "" {
+		postDir = e.steps.configurePostDir
+	}
+
+	return e.runManyIn(postDir, post)
+}
+
+// configurePreDir returns the directory configure_pre runs in: the build
+// directory for cmake and meson which always build out of tree, $S otherwise
+func (e *buildEnv) configurePreDir() string {
+	engine := e.i.Engine
+	if engine == "auto" || engine == "" {
+		engine, _, _ = e.detectEngine()
+	}
+
+	switch engine {
+	case "cmake", "meson":
+		return e.temp
+	}
+	return e.src
+}
+
+// downloadEngine runs the download step of the build engine, if it has one
+func (e *buildEnv) downloadEngine() error {
+	engine := e.i.Engine
+	if engine == "auto" || engine == "" {
+		var err error
+		engine, _, err = e.detectEngine()
+		if err != nil {
+			// initEngine will report this once the sources are patched
+			return nil
+		}
+	}
+
+	f, ok := engineDownloads[engine]
+	if !ok {
+		return nil
+	}
+	return f(e)
+}
+
+// initEngine detects the build engine if needed, and prepares its steps
+func (e *buildEnv) initEngine() error {
+	if e.i.Engine == "auto" || e.i.Engine == "" {
+		engine, opts, err := e.detectEngine()
+		if err != nil {
+			return err
+		}
+		log.Printf("detected build engine: %s", engine)
+
+		// keep the rest of the instructions (hooks, arguments, etc)
+		i := *e.i
+		i.Engine = engine
+		i.Options = append(append([]string{}, e.i.Options...), opts...)
+		e.i = &i
+	}
+
+	f, ok := buildEngines[e.i.Engine]
+	if !ok {
+		return fmt.Errorf("unsupported engine: %s", e.i.Engine)
+	}
+
+	steps, err := f(e)
+	if err != nil {
+		return err
+	}
+	e.steps = steps
+	return nil
+}
+
+// detectEngine finds the engine to use based on files found in $S, and any
+// option this engine will need
+func (e *buildEnv) detectEngine() (string, []string, error) {
+	checks := []struct {
+		file   string
+		engine string
+		opts   []string
+	}{
+		{"CMakeLists.txt", "cmake", nil},
+		{"meson_options.txt", "meson", nil},
+		{"configure", "autoconf", nil},
+		{"configure.ac", "autoconf", []string{"autoreconf"}},
+		{"*.pro", "qmake", nil},
+		{"SConstruct", "scons", nil},
+		{"wscript", "waf", nil},
+		{"pyproject.toml", "python", nil},
+		{"setup.py", "python", nil},
+		{"Cargo.toml", "cargo", nil},
+		{"go.mod", "go", nil},
+		{"GNUmakefile", "make", nil},
+		{"Makefile", "make", nil},
+		{"makefile", "make", nil},
+		{"Build.PL", "perl", nil},
+		{"Makefile.PL", "perl", nil},
+	}
+
+	for _, c := range checks {
+		if c.file == "*.pro" {
+			if e.findQmakeProject(e.src) != "" {
+				return c.engine, c.opts, nil
+			}
+			continue
+		}
+		if _, err := e.backend.Stat(filepath.Join(e.src, c.file)); err == nil {
+			return c.engine, c.opts, nil
+		}
+	}
+
+	return "", nil, errors.New("could not detect build type")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildPython() (*engineSteps, error) {
+	// allow override of pythonRoot via PYTHON_ROOT
+	pythonRoot := e.src
+	if v := e.getVar("PYTHON_ROOT"); v != "" {
+		pythonRoot = v
+	}
+
+	versions, err := e.pythonVersions()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("python: building for versions %s", strings.Join(versions, ", "))
+
+	var args []string
+	for _, arg := range e.i.Arguments {
+		arg, err = shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	e.vars["PIP_DISABLE_PIP_VERSION_CHECK"] = "1"
+
+	buildDir := pythonRoot
+
+	compile := func() error {
+		for _, pyVer := range versions {
+			// build a wheel for each version of python, each in its own dir
+			wheelOpts := []string{
+				e.pythonBin(pyVer), "-m", "pip", "wheel",
+				"--no-deps", "--no-index", "--no-build-isolation",
+				"--wheel-dir", e.pythonWheelDir(pyVer),
+			}
+			wheelOpts = append(wheelOpts, args...)
+			wheelOpts = append(wheelOpts, pythonRoot)
+
+			err := e.runIn(buildDir, wheelOpts...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	install := func() error {
+		for _, pyVer := range versions {
+			list, err := e.backend.ReadDir(e.pythonWheelDir(pyVer))
+			if err != nil {
+				return err
+			}
+
+			// files end in $PREFIX/lib/pythonX.Y, orgMoveLib moves lib to the libs subpackage and orgFixPython then moves libs/lib/pythonX.Y to the .mod.pyX.Y subpackage
+			installOpts := []string{
+				e.pythonBin(pyVer), "-m", "pip", "install",
+				"--no-deps", "--no-index", "--ignore-installed",
+				"--root", e.dist,
+				"--prefix", e.getDir("core"),
+			}
+			found := false
+			for _, f := range list {
+				if strings.HasSuffix(f.Name(), ".whl") {
+					installOpts = append(installOpts, filepath.Join(e.pythonWheelDir(pyVer), f.Name()))
+					found = true
+				}
+			}
+			if !found {
+				return errors.New("python: no wheel was built for python " + pyVer)
+			}
+
+			err = e.runIn(buildDir, installOpts...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return &engineSteps{
+		dir:     buildDir,
+		compile: compile,
+		install: install,
+	}, nil
+}
+
+// pythonVersions returns the list of python versions (eg. 3.10) we should build for, oldest first
+func (e *buildEnv) pythonVersions() ([]string, error) {
+	// allow override via PYTHON_VERSIONS (space separated)
+	if v := e.getVar("PYTHON_VERSIONS"); v != "" {
+		return strings.Fields(v), nil
+	}
+
+	list, err := e.backend.ReadDir("/pkg/main")
+	if err != nil {
+		return nil, err
+	}
+
+	// look for dev-lang.python.core.3.10.2.linux.amd64
+	prefix := "dev-lang.python.core."
+	suffix := "." + e.os + "." + e.arch
+	found := make(map[string]bool)
+	var res []string
+
+	for _, f := range list {
+		nam := f.Name()
+		if !strings.HasPrefix(nam, prefix) || !strings.HasSuffix(nam, suffix) {
+			continue
+		}
+		vers := strings.Split(trimOsArch(strings.TrimPrefix(nam, prefix)), ".")
+		if len(vers) < 2 {
+			continue
+		}
+		if major, err := strconv.Atoi(vers[0]); err != nil || major < 3 {
+			// pip & wheels are only supported with python 3
+			continue
+		}
+		pyVer := vers[0] + "." + vers[1]
+		if found[pyVer] {
+			continue
+		}
+		found[pyVer] = true
+		res = append(res, pyVer)
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("python: could not find any installed version of dev-lang/python")
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return pyVerLess(res[i], res[j])
+	})
+
+	return res, nil
+}
+
+func (e *buildEnv) pythonBin(pyVer string) string {
+	return "/pkg/main/dev-lang.python.core." + pyVer + "/bin/python" + pyVer
+}
+
+func (e *buildEnv) pythonWheelDir(pyVer string) string {
+	return filepath.Join(e.temp, "wheel-py"+pyVer)
+}
+
+// pyVerLess compares two python versions such as 3.9 and 3.10
+func pyVerLess(a, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr != nil || berr != nil {
+			if as[i] != bs[i] {
+				return as[i] < bs[i]
+			}
+			continue
+		}
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestPyVerLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"3.9", "3.10", true},
+		{"3.10", "3.9", false},
+		{"3.10", "3.10", false},
+		{"3.10", "3.10.1", true},
+		{"2.7", "3.6", true},
+		{"3.11", "4.0", true},
+	}
+
+	for _, tt := range tests {
+		if got := pyVerLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("pyVerLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
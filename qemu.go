@@ -2,57 +2,62 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
-	"net"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
-func NewQemuBackend(tgtos, arch string) (Backend, error) {
-	qemuExe := ""
-	qemuMachine := ""
-	var port int
-	switch arch {
-	case "amd64":
-		qemuExe = "qemu-system-x86_64"
-		qemuMachine = "q35"
-		port = 10088
-	case "386":
-		qemuExe = "qemu-system-x86_64"
-		qemuMachine = "q35"
-		port = 10089
-	case "arm64":
-		qemuExe = "qemu-system-aarch64"
-		qemuMachine = "virt"
-		port = 10090
-	default:
-		return nil, fmt.Errorf("qemu arch not supported: %s", arch)
-	}
-
-	// let's try once to see if qemu is out there
-
-	cfg := &ssh.ClientConfig{
-		User: "root",
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// accept anything
-			return nil
-		},
-		Timeout: 10 * time.Second,
-	}
-
-	sshc, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), cfg)
-	if err == nil {
-		// ooh, let's try that
-		return NewSshBackend(sshc)
+// NewQemuBackend returns a backend running in a QEMU VM for arch, reusing an
+// idle VM if there is one. If want is set, only an idle VM it accepts is used.
+func NewQemuBackend(tgtos, arch string, qc *qemuConfig, want func(vm *qemuVM, be Backend) bool) (Backend, error) {
+	// reuse a VM that is already running if one is idle
+	var be Backend
+	for _, vm := range idleQemuVMs(arch) {
+		if be != nil {
+			vm.unlock()
+			continue
+		}
+		b, err := vm.connect()
+		if err != nil {
+			log.Printf("qemu: could not use VM %s: %s", vm.id(), err)
+			vm.unlock()
+			continue
+		}
+		if want != nil && !want(vm, b) {
+			// this also unlocks the VM
+			b.Close()
+			continue
+		}
+		log.Printf("qemu: using running VM %s", vm.id())
+		be = b
+	}
+	if be != nil {
+		return be, nil
+	}
+	if want != nil {
+		return nil, errors.New("no idle VM holds the previous build, it may have been stopped or be in use by another build")
 	}
 
+	vm, err := startQemuVM(tgtos, arch, qc)
+	if err != nil {
+		return nil, err
+	}
+	return vm.waitReady(qc.BootTimeout)
+}
+
+// startQemuVM launches a new VM for arch, locked. QEMU runs in its own session
+// so it keeps running after apkg-build exits, with its output in qemu.log.
+func startQemuVM(tgtos, arch string, qc *qemuConfig) (*qemuVM, error) {
 	// launch qemu... first we need to find out kernel version
 	kverB, err := os.ReadFile("/pkg/main/sys-kernel.linux.core." + tgtos + "." + arch + "/version.txt")
 	if err != nil {
@@ -61,93 +66,44 @@ func NewQemuBackend(tgtos, arch string) (Backend, error) {
 	kver := strings.TrimSpace(string(kverB))
 	log.Printf("qemu: running with kernel %s", kver)
 
-	// let's try to locate initrd for this kernel
-	initrd := fmt.Sprintf("/tmp/initrd-apkg-build.kernel.%s.%s.img", arch, kver)
-	if _, err := os.Stat(initrd); err != nil {
-		// we need to create initrd
-		log.Printf("Creating %s ...", initrd)
-		cpio := fmt.Sprintf("/tmp/initrd-apkg-build.kernel.%s.%s.cpio", arch, kver)
-		c := exec.Command("/bin/bash", "-c", "find . | cpio -H newc -o -R +0:+0 -V --file "+cpio)
-		c.Dir = "/pkg/main/sys-kernel.linux.modules." + kver + "." + tgtos + "." + arch
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-		err = c.Run()
-		if err != nil {
-			return nil, err
-		}
-
-		// let's use /tmp
-		os.MkdirAll("/tmp/usr/azusa", 0755)
-		err = cloneFile("/pkg/main/sys-apps.busybox.core."+tgtos+"."+arch+"/bin/busybox", "/tmp/usr/azusa/busybox")
-		if err != nil {
-			return nil, err
-		}
-		err = cloneFile("/pkg/main/sys-apps.busybox.doc."+tgtos+"."+arch+"/examples/udhcp/simple.script", "/tmp/usr/azusa/simple.script")
-		if err != nil {
-			return nil, err
-		}
-		err = cloneFile("/pkg/main/azusa.apkg.core."+tgtos+"."+arch+"/apkg", "/tmp/usr/azusa/apkg")
-		if err != nil {
-			return nil, err
-		}
-		str := strings.ReplaceAll(initData, "__ARCH__", arch)
-		err = os.WriteFile("/tmp/init", []byte(str), 0755)
-		if err != nil {
-			return nil, err
-		}
-
-		// update cpio
-		buf := &bytes.Buffer{}
-		fmt.Fprintf(buf, "usr\nusr/azusa\nusr/azusa/busybox\nusr/azusa/simple.script\nusr/azusa/apkg\ninit\n")
-
-		c = exec.Command("cpio", "-H", "newc", "-o", "-R", "+0:+0", "-V", "--append", "--file", cpio)
-		c.Dir = "/tmp"
-		c.Stdin = bytes.NewReader(buf.Bytes())
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-		err = c.Run()
-		if err != nil {
-			return nil, err
-		}
+	initrd, err := qemuInitrd(tgtos, arch, kver)
+	if err != nil {
+		return nil, err
+	}
 
-		// cleanup (TODO use a temp subdir for that)
-		os.Remove("/tmp/init")
-		os.RemoveAll("/tmp/usr")
+	vm, err := newQemuVM(arch)
+	if err != nil {
+		return nil, err
+	}
+	vm.Initrd = initrd
 
-		// compress
-		c = exec.Command("xz", "-v", "--check=crc32", "--x86", "--lzma2", "--stdout", cpio)
-		out, err := os.Create(initrd)
-		if err != nil {
-			return nil, err
-		}
-		c.Stdout = out
-		c.Stderr = os.Stderr
-		err = c.Run()
-		out.Close()
+	port := qc.Port
+	if port == 0 {
+		port, err = freePort()
 		if err != nil {
+			vm.remove()
 			return nil, err
 		}
-
-		os.Remove(cpio)
 	}
+	vm.Port = port
 
-	log.Printf("qemu: using qemu %s port %d for SSH", qemuExe, port)
+	log.Printf("qemu: using qemu %s port %d for SSH", qc.Binary, port)
 
 	// create a disk image
-	diskImage := fmt.Sprintf("/tmp/qemu-build-%s.qcow2", arch)
-	os.Remove(diskImage)
-	err = exec.Command("/pkg/main/app-emulation.qemu.core/bin/qemu-img", "create", "-f", "qcow2", diskImage, "128G").Run()
+	diskImage := vm.disk()
+	err = exec.Command(filepath.Join(qc.Path, "qemu-img"), "create", "-f", "qcow2", diskImage, qc.DiskSize).Run()
 	if err != nil {
+		vm.remove()
 		return nil, fmt.Errorf("failed to create build temp image: %w", err)
 	}
 
 	qemuCmd := []string{
-		"/pkg/main/app-emulation.qemu.core/bin/" + qemuExe,
+		filepath.Join(qc.Path, qc.Binary),
 		"-kernel", "/pkg/main/sys-kernel.linux.core." + kver + "." + tgtos + "." + arch + "/linux-" + kver + ".img",
 		"-initrd", initrd,
-		//"-append", "console=ttyS0",
-		//"-serial", "stdio", // exclusive with -nographic
-		"-M", qemuMachine,
+		"-append", "console=" + qc.Console,
+		"-serial", "file:" + vm.consoleFile(),
+		"-M", qc.Machine,
 		"-netdev", fmt.Sprintf("user,id=hostnet0,hostfwd=tcp:127.0.0.1:%d-:22", port),
 		"-device", "e1000,netdev=hostnet0",
 		"-blockdev", "{\"driver\":\"file\",\"filename\":\"" + diskImage + "\",\"node-name\":\"build-storage\",\"discard\":\"unmap\"}",
@@ -155,72 +111,265 @@ func NewQemuBackend(tgtos, arch string) (Backend, error) {
 		"-device", "ich9-ahci,id=ahci",
 		"-device", "ide-hd,drive=build-format,id=disk0,bus=ahci.0",
 		"-device", "virtio-balloon",
+		"-display", "none",
 	}
-	switch arch {
-	case "amd64", "386":
-		qemuCmd = append(qemuCmd,
-			"--enable-kvm",
-			"-cpu", "host",
-			"-smp", strconv.Itoa(runtime.NumCPU()),
-			"-m", "16384,slots=2,maxmem=32G",
-		)
-	case "arm64":
-		qemuCmd = append(qemuCmd,
-			"-cpu", "max", //"cortex-a53",
-			"-smp", "4",
-			//"-serial", "stdio",
-			//"-append", "console=ttyS0",
-			"-m", "4096,slots=2,maxmem=16G",
-		)
+	if *qc.KVM {
+		qemuCmd = append(qemuCmd, "--enable-kvm")
 	}
+	qemuCmd = append(qemuCmd,
+		"-cpu", qc.CPU,
+		"-smp", strconv.Itoa(qc.SMP),
+		"-m", qc.memoryArg(),
+	)
+
+	out, err := os.Create(vm.logFile())
+	if err != nil {
+		vm.remove()
+		return nil, err
+	}
+	defer out.Close()
 
 	log.Printf("Running QEMU: %s", strings.Join(qemuCmd, " "))
 	c := exec.Command(qemuCmd[0], qemuCmd[1:]...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	c.Stdout = out
+	c.Stderr = out
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 
 	if err := c.Start(); err != nil {
+		vm.remove()
 		return nil, fmt.Errorf("failed to start QEMU: %w", err)
 	}
+	// supervise QEMU while we are running, so a failure is noticed at once
+	vm.exited = make(chan struct{})
+	go func() {
+		vm.exitErr = c.Wait()
+		close(vm.exited)
+	}()
+
+	vm.Pid = c.Process.Pid
+	vm.Started = time.Now()
+	if err := vm.save(); err != nil {
+		log.Printf("WARNING: failed to save VM state: %s", err)
+	}
+	log.Printf("qemu: started VM %s (pid %d)", vm.id(), vm.Pid)
+	return vm, nil
+}
 
-	// let's try to connect to this port
+// waitReady waits until the VM accepts ssh connections and returns its
+// backend, retrying with an exponential backoff. The VM is stopped if it does
+// not become ready within timeout.
+func (v *qemuVM) waitReady(timeout time.Duration) (Backend, error) {
 	log.Printf("Waiting for qemu to finish loading...")
 
-	const maxRetries = 60 // 2 minutes max wait time
-	for i := 0; i < maxRetries; i++ {
-		sshc, err = ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), cfg)
-		if err != nil {
-			// Check if QEMU process is still running
-			if c.ProcessState != nil && c.ProcessState.Exited() {
-				return nil, fmt.Errorf("QEMU process exited unexpectedly")
-			}
-			time.Sleep(2 * time.Second)
-			continue
+	deadline := time.Now().Add(timeout)
+	delay := 250 * time.Millisecond
+	for {
+		be, err := v.connect()
+		if err == nil {
+			return be, nil
 		}
-		be, err := NewSshBackend(sshc)
-		if err != nil {
-			sshc.Close()
-			time.Sleep(2 * time.Second)
-			continue
+		left := time.Until(deadline)
+		if left <= 0 {
+			break
+		}
+		if delay > left {
+			delay = left
 		}
 
-		return be, nil
+		wait := time.NewTimer(delay)
+		select {
+		case <-v.exited:
+			wait.Stop()
+			err := v.exitError()
+			v.remove()
+			return nil, err
+		case <-wait.C:
+		}
+		if v.exited == nil && !v.running() {
+			// QEMU was not started by us
+			err := v.exitError()
+			v.remove()
+			return nil, err
+		}
+
+		delay *= 2
+		if delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
 	}
 
 	// Timeout reached, kill QEMU
-	c.Process.Kill()
-	return nil, fmt.Errorf("timeout waiting for QEMU to become ready after %d seconds", maxRetries*2)
+	v.kill()
+	console := v.consoleTail()
+	v.remove()
+	return nil, fmt.Errorf("timeout waiting for QEMU to become ready after %s (see boot_timeout in the configuration)%s", timeout, console)
+}
+
+// qemuInitrd returns the path of the initrd for kernel kver, creating it and
+// its keys if needed. Keys are kept whenever possible, as VMs started from a
+// previous initrd are still using them.
+func qemuInitrd(tgtos, arch, kver string) (string, error) {
+	dir, err := qemuDir()
+	if err != nil {
+		return "", err
+	}
+	lock, err := lockQemuDir(dir)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+
+	initrd := filepath.Join(dir, fmt.Sprintf("initrd-apkg-build.kernel.%s.%s.img", arch, kver))
+	keys, err := loadQemuKeys(initrd)
+	if err == nil {
+		if _, err := os.Stat(initrd); err == nil {
+			return initrd, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("qemu: creating new keys for %s: %s", initrd, err)
+	}
+
+	if keys == nil || keys.hostPEM == nil {
+		// VMs started from the previous initrd, if any, can't be used anymore
+		keys, err = newQemuKeys()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = makeInitrd(tgtos, arch, kver, initrd, keys)
+	if err != nil {
+		return "", err
+	}
+	return initrd, nil
+}
+
+// qemuPkgDir is where makeInitrd takes the kernel modules, busybox and apkg from
+var qemuPkgDir = "/pkg/main"
+
+// makeInitrd creates the initrd for a kernel, with the modules, busybox, apkg
+// and an init that runs dropbear with the given keys
+func makeInitrd(tgtos, arch, kver, initrd string, keys *qemuKeys) error {
+	log.Printf("Creating %s ...", initrd)
+
+	tmp, err := os.MkdirTemp("", "apkg-initrd-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	cpio := filepath.Join(tmp, "initrd.cpio")
+	c := exec.Command("/bin/bash", "-c", "find . | cpio -H newc -o -R +0:+0 -V --file "+cpio)
+	c.Dir = filepath.Join(qemuPkgDir, "sys-kernel.linux.modules."+kver+"."+tgtos+"."+arch)
+	c.Stdout = consoleStdout()
+	c.Stderr = os.Stderr
+	err = c.Run()
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(tmp, "root")
+	os.MkdirAll(filepath.Join(root, "usr/azusa"), 0755)
+	err = cloneFile(filepath.Join(qemuPkgDir, "sys-apps.busybox.core."+tgtos+"."+arch, "bin/busybox"), filepath.Join(root, "usr/azusa/busybox"))
+	if err != nil {
+		return err
+	}
+	err = cloneFile(filepath.Join(qemuPkgDir, "sys-apps.busybox.doc."+tgtos+"."+arch, "examples/udhcp/simple.script"), filepath.Join(root, "usr/azusa/simple.script"))
+	if err != nil {
+		return err
+	}
+	err = cloneFile(filepath.Join(qemuPkgDir, "azusa.apkg.core."+tgtos+"."+arch, "apkg"), filepath.Join(root, "usr/azusa/apkg"))
+	if err != nil {
+		return err
+	}
+	// contains the host private key
+	err = os.WriteFile(filepath.Join(root, "init"), []byte(keys.initScript(arch)), 0700)
+	if err != nil {
+		return err
+	}
+
+	// update cpio
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "usr\nusr/azusa\nusr/azusa/busybox\nusr/azusa/simple.script\nusr/azusa/apkg\ninit\n")
+
+	c = exec.Command("cpio", "-H", "newc", "-o", "-R", "+0:+0", "-V", "--append", "--file", cpio)
+	c.Dir = root
+	c.Stdin = bytes.NewReader(buf.Bytes())
+	c.Stdout = consoleStdout()
+	c.Stderr = os.Stderr
+	err = c.Run()
+	if err != nil {
+		return err
+	}
+
+	// compress, the initrd is only renamed in place once its keys are saved
+	c = exec.Command("xz", "-v", "--check=crc32", "--x86", "--lzma2", "--stdout", cpio)
+	out, err := os.OpenFile(initrd+"~", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(initrd + "~")
+	c.Stdout = out
+	c.Stderr = os.Stderr
+	err = c.Run()
+	out.Close()
+	if err != nil {
+		return err
+	}
+
+	err = keys.save(initrd)
+	if err == nil {
+		err = os.Rename(initrd+"~", initrd)
+	}
+	if err != nil {
+		// an initrd not matching the saved keys would not be usable
+		os.Remove(initrd)
+		return err
+	}
+	return nil
 }
 
 func (e *buildEnv) initQemu() error {
-	be, err := NewQemuBackend(e.os, e.arch)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	qc, err := cfg.qemu(e.arch)
+	if err != nil {
+		return err
+	}
+	var want func(vm *qemuVM, be Backend) bool
+	if e.resume {
+		// the previous build is on the disk of the VM it ran in
+		want = e.vmHoldsBuild
+	}
+	be, err := NewQemuBackend(e.os, e.arch, qc, want)
 	if err != nil {
 		return err
 	}
 	e.backend = be
+	e.backendName = "qemu"
 	return nil
 }
 
+// vmHoldsBuild checks the state of the previous build found in the VM was
+// saved by a build running in this VM
+func (e *buildEnv) vmHoldsBuild(vm *qemuVM, be Backend) bool {
+	base, err := be.Base()
+	if err != nil {
+		return false
+	}
+	data, err := be.ReadFile(filepath.Join(base, e.baseName(), "state.yaml"))
+	if err != nil {
+		return false
+	}
+	st := &buildState{}
+	if yaml.Unmarshal(data, st) != nil {
+		return false
+	}
+	return st.VM == vm.id()
+}
+
 const initData = `#!/usr/azusa/busybox ash
 
 mkdir /bin /sbin
@@ -328,12 +477,21 @@ mkdir /build/bin
 echo '#!/bin/bash' >/build/bin/ldconfig
 chmod +x /build/bin/ldconfig
 
-# set root password to empty
-sed -i 's/root:\*:/root::/' /etc/shadow
+# root can only login with the key of apkg-build
+ROOT_HOME="$(awk -F: '$1 == "root" { print $6 }' /etc/passwd)"
+mkdir -p "${ROOT_HOME:-/root}/.ssh"
+chmod 700 "${ROOT_HOME:-/root}/.ssh"
+echo '__AUTHORIZED_KEY__' >"${ROOT_HOME:-/root}/.ssh/authorized_keys"
+chmod 600 "${ROOT_HOME:-/root}/.ssh/authorized_keys"
 
 echo "Running dropbear..."
 mkdir /etc/dropbear
-dropbear -E -B -R
+cat >/etc/dropbear/host_key.pem <<'EOF'
+__HOST_KEY__
+EOF
+dropbearconvert openssh dropbear /etc/dropbear/host_key.pem /etc/dropbear/dropbear_ecdsa_host_key
+rm -f /etc/dropbear/host_key.pem
+dropbear -E -s -r /etc/dropbear/dropbear_ecdsa_host_key
 
 # Initialize activity timestamp
 touch /var/run/last_activity
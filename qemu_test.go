@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMakeInitrdEvents(t *testing.T) {
+	dir := t.TempDir()
+
+	// cpio -V prints a dot for each file on stdout, xz only writes the
+	// compressed data there
+	bin := filepath.Join(dir, "bin")
+	scripts := map[string]string{
+		"cpio": "#!/bin/sh\nwhile read f; do printf .; done\necho\n: > \"$(eval echo \\${$#})\"\n",
+		"xz":   "#!/bin/sh\necho compressed\n",
+	}
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	pkg := filepath.Join(dir, "pkg")
+	files := []string{
+		"sys-kernel.linux.modules.6.1.0.linux.amd64/lib/modules/6.1.0/modules.dep",
+		"sys-apps.busybox.core.linux.amd64/bin/busybox",
+		"sys-apps.busybox.doc.linux.amd64/examples/udhcp/simple.script",
+		"azusa.apkg.core.linux.amd64/apkg",
+	}
+	for _, f := range files {
+		fn := filepath.Join(pkg, f)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPkgDir := qemuPkgDir
+	qemuPkgDir = pkg
+	defer func() { qemuPkgDir = oldPkgDir }()
+
+	// events on stdout, with stdout and stderr redirected to files
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	oldStdout, oldStderr, oldEvents := os.Stdout, os.Stderr, events
+	os.Stdout, os.Stderr = stdout, stderr
+	events = &eventStream{w: stdout, enc: json.NewEncoder(stdout), fd: 1}
+	defer func() { os.Stdout, os.Stderr, events = oldStdout, oldStderr, oldEvents }()
+
+	keys, err := newQemuKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initrd := filepath.Join(dir, "initrd.img")
+
+	events.emit(&buildEvent{Type: "build_start"})
+	err = makeInitrd("linux", "amd64", "6.1.0", initrd, keys)
+	events.emit(&buildEvent{Type: "build_end"})
+	os.Stdout, os.Stderr, events = oldStdout, oldStderr, oldEvents
+	if err != nil {
+		t.Fatalf("makeInitrd() error: %s", err)
+	}
+	if _, err := os.Stat(initrd); err != nil {
+		t.Errorf("initrd was not created: %s", err)
+	}
+
+	if _, err := stdout.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	s := bufio.NewScanner(stdout)
+	for s.Scan() {
+		var ev buildEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			t.Errorf("line %d of the event stream is not JSON: %q", n+1, s.Text())
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("got %d events, want 2", n)
+	}
+}
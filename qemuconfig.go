@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// qemuConfig holds the settings of the QEMU VM of an arch. Fields left empty
+// in the configuration file take the default of the arch.
+type qemuConfig struct {
+	Path      string `yaml:"path,omitempty"`   // directory containing the QEMU binaries
+	Binary    string `yaml:"binary,omitempty"` // eg. qemu-system-aarch64
+	Machine   string `yaml:"machine,omitempty"`
+	CPU       string `yaml:"cpu,omitempty"`
+	Console   string `yaml:"console,omitempty"` // serial console device in the VM, eg. ttyS0
+	KVM       *bool  `yaml:"kvm,omitempty"`
+	SMP       int    `yaml:"smp,omitempty"`
+	Memory    string `yaml:"memory,omitempty"`     // eg. 4G
+	MaxMemory string `yaml:"max_memory,omitempty"` // memory can be hotplugged up to this
+	DiskSize  string `yaml:"disk_size,omitempty"`
+	Port      int    `yaml:"port,omitempty"` // local port forwarded to ssh in the VM, a free port is used if not set
+
+	BootTimeout time.Duration `yaml:"boot_timeout,omitempty"` // how long to wait for ssh after starting the VM
+}
+
+func qemuDefaults(arch string) (*qemuConfig, error) {
+	yes, no := true, false
+	cfg := &qemuConfig{
+		Path:     "/pkg/main/app-emulation.qemu.core/bin",
+		DiskSize: "128G",
+	}
+
+	switch arch {
+	case "amd64", "386":
+		cfg.Binary = "qemu-system-x86_64"
+		cfg.Machine = "q35"
+		cfg.CPU = "host"
+		cfg.Console = "ttyS0"
+		cfg.KVM = &yes
+		cfg.SMP = runtime.NumCPU()
+		cfg.Memory = "16G"
+		cfg.MaxMemory = "32G"
+		cfg.BootTimeout = 2 * time.Minute
+	case "arm64":
+		cfg.Binary = "qemu-system-aarch64"
+		cfg.Machine = "virt"
+		cfg.CPU = "max"
+		cfg.Console = "ttyAMA0"
+		cfg.KVM = &no
+		cfg.SMP = 4
+		cfg.Memory = "4G"
+		cfg.MaxMemory = "16G"
+		// no KVM, booting is much slower
+		cfg.BootTimeout = 5 * time.Minute
+	default:
+		return nil, fmt.Errorf("qemu arch not supported: %s", arch)
+	}
+	return cfg, nil
+}
+
+// qemu returns the settings of the VM for arch, the defaults of the arch
+// overridden by the configuration file
+func (c *apkgConfig) qemu(arch string) (*qemuConfig, error) {
+	cfg, err := qemuDefaults(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	o, ok := c.Qemu[arch]
+	if !ok {
+		return cfg, nil
+	}
+	if o.Path != "" {
+		cfg.Path = o.Path
+	}
+	if o.Binary != "" {
+		cfg.Binary = o.Binary
+	}
+	if o.Machine != "" {
+		cfg.Machine = o.Machine
+	}
+	if o.CPU != "" {
+		cfg.CPU = o.CPU
+	}
+	if o.Console != "" {
+		cfg.Console = o.Console
+	}
+	if o.KVM != nil {
+		cfg.KVM = o.KVM
+	}
+	if o.SMP != 0 {
+		cfg.SMP = o.SMP
+	}
+	if o.Memory != "" {
+		cfg.Memory = o.Memory
+		if o.MaxMemory == "" {
+			// keep the default if large enough
+			if m, _ := parseSize(cfg.Memory); m > mustParseSize(cfg.MaxMemory) {
+				cfg.MaxMemory = cfg.Memory
+			}
+		}
+	}
+	if o.MaxMemory != "" {
+		cfg.MaxMemory = o.MaxMemory
+	}
+	if o.DiskSize != "" {
+		cfg.DiskSize = o.DiskSize
+	}
+	if o.Port != 0 {
+		cfg.Port = o.Port
+	}
+	if o.BootTimeout != 0 {
+		cfg.BootTimeout = o.BootTimeout
+	}
+	return cfg, nil
+}
+
+func (q *qemuConfig) validate() error {
+	if !filepath.IsAbs(q.Path) {
+		return fmt.Errorf("path must be absolute: %s", q.Path)
+	}
+	if strings.ContainsRune(q.Binary, '/') {
+		return fmt.Errorf("binary must be a file name in path: %s", q.Binary)
+	}
+	if q.SMP < 1 {
+		return fmt.Errorf("invalid smp: %d", q.SMP)
+	}
+	if q.Port < 0 || q.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", q.Port)
+	}
+	if q.BootTimeout <= 0 {
+		return fmt.Errorf("invalid boot_timeout: %s", q.BootTimeout)
+	}
+
+	mem, err := parseSize(q.Memory)
+	if err != nil {
+		return fmt.Errorf("memory: %w", err)
+	}
+	if mem < 512<<20 {
+		return fmt.Errorf("memory: at least 512M is needed, got %s", q.Memory)
+	}
+	maxMem, err := parseSize(q.MaxMemory)
+	if err != nil {
+		return fmt.Errorf("max_memory: %w", err)
+	}
+	if maxMem < mem {
+		return fmt.Errorf("max_memory (%s) is lower than memory (%s)", q.MaxMemory, q.Memory)
+	}
+	disk, err := parseSize(q.DiskSize)
+	if err != nil {
+		return fmt.Errorf("disk_size: %w", err)
+	}
+	if disk < 1<<30 {
+		return fmt.Errorf("disk_size: at least 1G is needed, got %s", q.DiskSize)
+	}
+	return nil
+}
+
+// validateQemu checks the settings of each arch, and that VMs with a fixed port
+// don't use the same one
+func (c *apkgConfig) validateQemu() error {
+	ports := make(map[int]string)
+	for _, arch := range []string{"amd64", "386", "arm64"} {
+		q, err := c.qemu(arch)
+		if err != nil {
+			return err
+		}
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("qemu %s: %w", arch, err)
+		}
+		if q.Port == 0 {
+			continue
+		}
+		if other, ok := ports[q.Port]; ok {
+			return fmt.Errorf("qemu %s: port %d is already used by %s", arch, q.Port, other)
+		}
+		ports[q.Port] = arch
+	}
+	for arch := range c.Qemu {
+		if _, err := qemuDefaults(arch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryArg returns the value of QEMU's -m option
+func (q *qemuConfig) memoryArg() string {
+	return fmt.Sprintf("%dM,slots=2,maxmem=%dM", mustParseSize(q.Memory)>>20, mustParseSize(q.MaxMemory)>>20)
+}
+
+// parseSize parses a size such as 512M or 16G, in bytes. Suffixes are powers
+// of 1024, as with QEMU.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	num := strings.TrimRight(strings.TrimSuffix(s, "B"), "KMGT")
+	var mult int64 = 1
+	switch strings.TrimSuffix(s, "B")[len(num):] {
+	case "":
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * mult, nil
+}
+
+// mustParseSize is for sizes that went through validate
+func mustParseSize(s string) int64 {
+	n, err := parseSize(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
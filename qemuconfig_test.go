@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"1024", 1024, false},
+		{"512M", 512 << 20, false},
+		{"16G", 16 << 30, false},
+		{"16GB", 16 << 30, false},
+		{"2T", 2 << 40, false},
+		{"4K", 4 << 10, false},
+		{"", 0, true},
+		{"B", 0, true},
+		{"0", 0, true},
+		{"-1G", 0, true},
+		{"1.5G", 0, true},
+		{"4KG", 0, true},
+		{"12X", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d (error: %v)", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestQemuConfigValidate(t *testing.T) {
+	valid := func() *qemuConfig {
+		q, err := qemuDefaults("amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	tests := []struct {
+		name   string
+		modify func(q *qemuConfig)
+		err    string // expected in the error, empty if valid
+	}{
+		{"defaults", func(q *qemuConfig) {}, ""},
+		{"relative path", func(q *qemuConfig) { q.Path = "bin" }, "path must be absolute"},
+		{"binary with path", func(q *qemuConfig) { q.Binary = "/usr/bin/qemu-system-x86_64" }, "binary must be a file name"},
+		{"no smp", func(q *qemuConfig) { q.SMP = 0 }, "invalid smp"},
+		{"port out of range", func(q *qemuConfig) { q.Port = 70000 }, "invalid port"},
+		{"fixed port", func(q *qemuConfig) { q.Port = 10022 }, ""},
+		{"no boot timeout", func(q *qemuConfig) { q.BootTimeout = 0 }, "invalid boot_timeout"},
+		{"invalid memory", func(q *qemuConfig) { q.Memory = "lots" }, "memory: invalid size"},
+		{"small memory", func(q *qemuConfig) { q.Memory = "256M" }, "at least 512M"},
+		{"max memory below memory", func(q *qemuConfig) { q.Memory, q.MaxMemory = "8G", "4G" }, "max_memory (4G) is lower than memory (8G)"},
+		{"small disk", func(q *qemuConfig) { q.DiskSize = "512M" }, "at least 1G"},
+		{"large config", func(q *qemuConfig) {
+			q.Memory, q.MaxMemory, q.DiskSize, q.BootTimeout = "64G", "128G", "1T", 10*time.Minute
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		q := valid()
+		tt.modify(q)
+		err := q.validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: expected error containing %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error %q does not contain %q", tt.name, err, tt.err)
+		}
+	}
+}
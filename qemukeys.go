@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// qemuKeys are the ssh keys generated along with an initrd: the VM only
+// accepts the client key for root, and we only accept the VM's host key
+type qemuKeys struct {
+	client    ssh.Signer
+	clientPEM []byte
+	host      ssh.PublicKey
+	hostPEM   []byte // host private key, converted to the dropbear format by the init
+}
+
+// qemuDir returns the directory initrds and their keys are kept in
+func qemuDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "apkg-build", "qemu")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// genKey returns a new ECDSA key, along with its PEM encoding in the
+// traditional format that dropbearconvert can read
+func genKey() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func newQemuKeys() (*qemuKeys, error) {
+	clientKey, clientPEM, err := genKey()
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, hostPEM, err := genKey()
+	if err != nil {
+		return nil, err
+	}
+	host, err := ssh.NewPublicKey(&hostKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &qemuKeys{client: client, clientPEM: clientPEM, host: host, hostPEM: hostPEM}, nil
+}
+
+// save writes the keys next to the initrd, so a VM started earlier can be
+// reused. The host private key is kept too, so the initrd can be created
+// again with the same keys.
+func (k *qemuKeys) save(initrd string) error {
+	err := writeFileRename(initrd+".key", k.clientPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileRename(initrd+".host", k.hostPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return writeFileRename(initrd+".host.pub", ssh.MarshalAuthorizedKey(k.host), 0600)
+}
+
+func loadQemuKeys(initrd string) (*qemuKeys, error) {
+	clientPEM, err := os.ReadFile(initrd + ".key")
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.ParsePrivateKey(clientPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s.key: %w", initrd, err)
+	}
+
+	hostData, err := os.ReadFile(initrd + ".host.pub")
+	if err != nil {
+		return nil, err
+	}
+	host, _, _, _, err := ssh.ParseAuthorizedKey(hostData)
+	if err != nil {
+		return nil, fmt.Errorf("%s.host.pub: %w", initrd, err)
+	}
+
+	// only needed to create the initrd again
+	hostPEM, _ := os.ReadFile(initrd + ".host")
+
+	return &qemuKeys{client: client, clientPEM: clientPEM, host: host, hostPEM: hostPEM}, nil
+}
+
+// lockQemuDir takes the lock of the qemu directory, so only one apkg-build
+// process checks and creates initrds at a time
+func lockQemuDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (k *qemuKeys) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:              "root",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(k.client)},
+		HostKeyCallback:   ssh.FixedHostKey(k.host),
+		HostKeyAlgorithms: hostKeyAlgorithms(k.host),
+		Timeout:           10 * time.Second,
+	}
+}
+
+// initScript returns the init of the initrd, with the keys baked in
+func (k *qemuKeys) initScript(arch string) string {
+	str := strings.ReplaceAll(initData, "__ARCH__", arch)
+	str = strings.ReplaceAll(str, "__HOST_KEY__", strings.TrimSpace(string(k.hostPEM)))
+	str = strings.ReplaceAll(str, "__AUTHORIZED_KEY__", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.client.PublicKey()))))
+	return str
+}
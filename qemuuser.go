@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// binfmt_misc entries registered for qemu-user, by arch
+var qemuUserBinfmt = map[string]string{
+	"amd64": "qemu-x86_64",
+	"386":   "qemu-i386",
+	"arm64": "qemu-aarch64",
+}
+
+// NewQemuUserBackend returns a rootfs backend made of packages for arch, where
+// binaries run through qemu-user emulation registered with binfmt_misc. This
+// is much faster than a system VM for foreign archs as all the host cores can
+// be used.
+func NewQemuUserBackend(osName, arch string, pkgs []string) (Backend, error) {
+	var extra []string
+
+	if !hostRuns(arch) {
+		interp, err := qemuUserInterpreter(arch)
+		if err != nil {
+			return nil, err
+		}
+		if interp != "" {
+			extra = append(extra, interp)
+		}
+	}
+
+	return newRootfs(osName, arch, pkgs, extra)
+}
+
+// hostRuns returns true if binaries for arch run natively on this host
+func hostRuns(arch string) bool {
+	return arch == runtime.GOARCH || (arch == "386" && runtime.GOARCH == "amd64")
+}
+
+// qemuUserInterpreter checks that binfmt_misc runs binaries of arch with
+// qemu-user, and returns the interpreter that needs to be in the rootfs. This
+// is empty if the entry has the F flag, as the kernel then keeps the
+// interpreter open.
+func qemuUserInterpreter(arch string) (string, error) {
+	nam, ok := qemuUserBinfmt[arch]
+	if !ok {
+		return "", fmt.Errorf("qemu-user: arch not supported: %s", arch)
+	}
+
+	data, err := os.ReadFile("/proc/sys/fs/binfmt_misc/" + nam)
+	if err != nil {
+		return "", fmt.Errorf("qemu-user: binfmt_misc is not configured for %s: %w", nam, err)
+	}
+
+	enabled := false
+	var interp, flags string
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "enabled":
+			enabled = true
+		case strings.HasPrefix(line, "interpreter "):
+			interp = strings.TrimPrefix(line, "interpreter ")
+		case strings.HasPrefix(line, "flags: "):
+			flags = strings.TrimPrefix(line, "flags: ")
+		}
+	}
+
+	if !enabled {
+		return "", fmt.Errorf("qemu-user: binfmt_misc entry %s is disabled", nam)
+	}
+	if strings.ContainsRune(flags, 'F') {
+		return "", nil
+	}
+	if _, err := os.Stat(interp); err != nil {
+		return "", fmt.Errorf("qemu-user: interpreter for %s: %w", nam, err)
+	}
+	// this needs a static interpreter, as host libraries are not in the rootfs
+	return interp, nil
+}
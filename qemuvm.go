@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// qemuVM is a QEMU VM tracked in the state directory. Each VM has its own
+// directory holding its disk image, vm.json and a lock file. The lock is held
+// by the build using the VM, so concurrent builds each get their own VM, and
+// idle VMs are reused by the next build.
+type qemuVM struct {
+	dir  string
+	lock *os.File
+
+	// only set if QEMU was started by this process
+	exited  chan struct{} // closed once QEMU exits
+	exitErr error
+
+	Arch    string    `json:"arch"`
+	Pid     int       `json:"pid"`
+	Port    int       `json:"port"`
+	Initrd  string    `json:"initrd"` // the keys of the VM are next to it
+	Started time.Time `json:"started"`
+}
+
+// qemuBackend is the ssh backend of a VM, releasing the VM once closed
+type qemuBackend struct {
+	Backend
+	vm *qemuVM
+}
+
+func (b *qemuBackend) Close() error {
+	err := b.Backend.Close()
+	b.vm.unlock()
+	return err
+}
+
+func qemuVMDir() (string, error) {
+	dir, err := qemuDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "vm")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// lockVMDir takes the lock of a VM directory, failing if it is in use
+func lockVMDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// newQemuVM creates the directory of a new VM, locked
+func newQemuVM(arch string) (*qemuVM, error) {
+	base, err := qemuVMDir()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(base, arch+"-")
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockVMDir(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &qemuVM{dir: dir, lock: lock, Arch: arch}, nil
+}
+
+// listQemuVMs returns the VMs of arch found in the state directory, without
+// locking them
+func listQemuVMs(arch string) ([]*qemuVM, error) {
+	base, err := qemuVMDir()
+	if err != nil {
+		return nil, err
+	}
+	list, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*qemuVM
+	for _, f := range list {
+		if !f.IsDir() || !strings.HasPrefix(f.Name(), arch+"-") {
+			continue
+		}
+		v := &qemuVM{dir: filepath.Join(base, f.Name()), Arch: arch}
+		// vm.json is missing while the VM is being created
+		if data, err := os.ReadFile(filepath.Join(v.dir, "vm.json")); err == nil {
+			json.Unmarshal(data, v)
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// idleQemuVMs returns the running VMs of arch no build is using, locked.
+// Directories of VMs that are not running anymore are removed.
+func idleQemuVMs(arch string) []*qemuVM {
+	list, err := listQemuVMs(arch)
+	if err != nil {
+		return nil
+	}
+
+	var res []*qemuVM
+	for _, v := range list {
+		if !v.tryLock() {
+			// in use
+			continue
+		}
+		if !v.running() {
+			v.remove()
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+func (v *qemuVM) tryLock() bool {
+	lock, err := lockVMDir(v.dir)
+	if err != nil {
+		return false
+	}
+	v.lock = lock
+	return true
+}
+
+// id returns the name of the VM, as shown by apkg-build vm status
+func (v *qemuVM) id() string {
+	return filepath.Base(v.dir)
+}
+
+func (v *qemuVM) logFile() string {
+	return filepath.Join(v.dir, "qemu.log")
+}
+
+// consoleFile is where the serial console of the VM is written
+func (v *qemuVM) consoleFile() string {
+	return filepath.Join(v.dir, "console.log")
+}
+
+// consoleTail returns the last lines of the serial console, to be appended to
+// errors about the VM
+func (v *qemuVM) consoleTail() string {
+	lines := tailLines(v.consoleFile(), 20)
+	if len(lines) == 0 {
+		return ""
+	}
+	return "\nlast lines of the serial console:\n  " + strings.Join(lines, "\n  ")
+}
+
+// exitError describes why QEMU exited during boot, with the end of its output
+// and of the serial console
+func (v *qemuVM) exitError() error {
+	msg := "QEMU process exited unexpectedly"
+	var exitErr *exec.ExitError
+	if errors.As(v.exitErr, &exitErr) {
+		msg = fmt.Sprintf("QEMU process exited unexpectedly (%s)", exitErr.ProcessState)
+	}
+	if lines := tailLines(v.logFile(), 10); len(lines) > 0 {
+		msg += "\nQEMU output:\n  " + strings.Join(lines, "\n  ")
+	}
+	return errors.New(msg + v.consoleTail())
+}
+
+// tailLines returns the last n non-empty lines of a file
+func tailLines(fn string, n int) []string {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	var lines []string
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func (v *qemuVM) disk() string {
+	return filepath.Join(v.dir, "disk.qcow2")
+}
+
+func (v *qemuVM) save() error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(v.dir, "vm.json"), append(data, '\n'), 0600)
+}
+
+// running checks the process of the VM is still there, and is really QEMU
+// using this VM's disk rather than a reused pid
+func (v *qemuVM) running() bool {
+	if v.Pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(v.Pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", v.Pid))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(cmdline), v.disk())
+}
+
+func (v *qemuVM) unlock() {
+	if v.lock != nil {
+		v.lock.Close()
+		v.lock = nil
+	}
+}
+
+// remove deletes the directory of the VM, which must not be running
+func (v *qemuVM) remove() {
+	os.RemoveAll(v.dir)
+	v.unlock()
+}
+
+// freePort returns a local port that is currently not in use
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (v *qemuVM) dial() (*ssh.Client, error) {
+	keys, err := loadQemuKeys(v.Initrd)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", v.Port), keys.clientConfig())
+}
+
+// connect opens the ssh backend of a running VM
+func (v *qemuVM) connect() (Backend, error) {
+	sshc, err := v.dial()
+	if err != nil {
+		return nil, err
+	}
+	be, err := NewSshBackend(sshc)
+	if err != nil {
+		sshc.Close()
+		return nil, err
+	}
+	return &qemuBackend{Backend: be, vm: v}, nil
+}
+
+func (v *qemuVM) kill() {
+	if v.running() {
+		syscall.Kill(v.Pid, syscall.SIGKILL)
+	}
+}
+
+// stop powers off the VM through ssh, and kills QEMU if it is still running
+// after that
+func (v *qemuVM) stop() error {
+	if sshc, err := v.dial(); err == nil {
+		if sess, err := sshc.NewSession(); err == nil {
+			// the connection is lost as the VM goes down
+			sess.Run("sync; poweroff -f")
+			sess.Close()
+		}
+		sshc.Close()
+	}
+
+	for i := 0; i < 30 && v.running(); i++ {
+		time.Sleep(time.Second)
+	}
+	if v.running() {
+		log.Printf("qemu: VM %s did not power off, terminating it", v.id())
+		syscall.Kill(v.Pid, syscall.SIGTERM)
+		for i := 0; i < 10 && v.running(); i++ {
+			time.Sleep(time.Second)
+		}
+		v.kill()
+	}
+	if v.running() {
+		return fmt.Errorf("failed to stop VM %s (pid %d)", v.id(), v.Pid)
+	}
+	v.remove()
+	return nil
+}
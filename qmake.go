@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildQmake() (*engineSteps, error) {
+	// allow override of qmakeRoot via QMAKE_ROOT
+	qmakeRoot := e.src
+	if v := e.getVar("QMAKE_ROOT"); v != "" {
+		qmakeRoot = v
+	}
+
+	pro := e.findQmakeProject(qmakeRoot)
+	if pro == "" {
+		return nil, fmt.Errorf("could not find qmake project file in %s", qmakeRoot)
+	}
+
+	qmake := "qmake"
+	if v := e.getVar("QMAKE"); v != "" {
+		qmake = v
+	}
+
+	cppFlags := e.getVar("CPPFLAGS")
+
+	qmakeOpts := []string{
+		qmake,
+		pro,
+		"PREFIX=" + e.getDir("core"),
+		"CONFIG+=release",
+		"QMAKE_CFLAGS+=" + cppFlags,
+		"QMAKE_CXXFLAGS+=" + cppFlags,
+		"QMAKE_LFLAGS+=" + e.getVar("LDFLAGS"),
+	}
+
+	// Process custom arguments from build.yaml
+	for _, arg := range e.i.Arguments {
+		arg, err := shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		qmakeOpts = append(qmakeOpts, arg)
+	}
+
+	// shadow build
+	buildDir := e.temp
+
+	return &engineSteps{
+		dir: buildDir,
+		configure: func() error {
+			return e.runIn(buildDir, qmakeOpts...)
+		},
+		compile: func() error {
+			return e.runIn(buildDir, "make", "-j"+strconv.Itoa(runtime.NumCPU()))
+		},
+		test: func() error {
+			return e.runIn(buildDir, "make", "check")
+		},
+		install: func() error {
+			return e.runIn(buildDir, "make", "install", "INSTALL_ROOT="+e.dist)
+		},
+	}, nil
+}
+
+// findQmakeProject returns the .pro file found at the top of dir, preferring
+// one named after the package if there are several
+func (e *buildEnv) findQmakeProject(dir string) string {
+	list, err := e.backend.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	res := ""
+	for _, f := range list {
+		nam := f.Name()
+		if f.IsDir() || !strings.HasSuffix(nam, ".pro") {
+			continue
+		}
+		if strings.EqualFold(nam, e.name+".pro") {
+			return filepath.Join(dir, nam)
+		}
+		if res == "" {
+			res = filepath.Join(dir, nam)
+		}
+	}
+	return res
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootfsConfig describes the root filesystem of the rootfs backend, which only
+// contains the base packages and what the build imports
+type rootfsConfig struct {
+	Dir        string            `json:"dir"`             // tree prepared by prepareRootfs, used as the root
+	Packages   []string          `json:"packages"`        // entries of /pkg/main to make available
+	Links      map[string]string `json:"links,omitempty"` // links of /pkg/main, resolved for the target arch
+	Baselayout string            `json:"baselayout"`      // copied to the root, like the QEMU init does
+	Symlinks   string            `json:"symlinks"`        // provides /bin, /lib, etc
+	Extra      []string          `json:"extra,omitempty"` // host files made available read-only at the same path
+}
+
+// rootfsBin is in the rootfs only, and comes first in PATH. It is outside of
+// /build, which is hidden by the build directory bind when used as base.
+const rootfsBin = "/.apkg/bin"
+
+// rootfsExtra is where the extra files are bind mounted, they are linked from
+// their own path
+const rootfsExtra = "/.apkg/extra"
+
+// packages always available in the rootfs
+var rootfsBase = []string{
+	"azusa.baselayout",
+	"azusa.symlinks",
+	"sys-libs.glibc",
+	"sys-kernel.linux-headers",
+	"sys-libs.zlib",
+	"sys-libs.ncurses",
+	"sys-libs.readline",
+	"app-shells.bash",
+	"sys-apps.coreutils",
+	"sys-apps.util-linux",
+	"sys-apps.findutils",
+	"sys-apps.diffutils",
+	"sys-apps.grep",
+	"sys-apps.sed",
+	"sys-apps.gawk",
+	"sys-apps.file",
+	"sys-apps.which",
+	"app-arch.tar",
+	"app-arch.gzip",
+	"app-arch.bzip2",
+	"app-arch.xz-utils",
+	"app-arch.zstd",
+	"app-arch.unzip",
+	"sys-devel.gcc",
+	"sys-devel.binutils",
+	"dev-libs.gmp",
+	"dev-libs.mpfr",
+	"dev-libs.mpc",
+	"dev-libs.isl",
+	"sys-devel.make",
+	"sys-devel.patch",
+	"dev-util.pkgconf",
+	"dev-util.patchelf",
+	"sys-fs.squashfs-tools",
+}
+
+// packages needed by each engine
+var rootfsEngines = map[string][]string{
+	"autoconf": {"sys-devel.autoconf", "sys-devel.automake", "sys-devel.libtool", "sys-devel.m4", "sys-devel.gnuconfig"},
+	"cmake":    {"dev-util.cmake", "dev-util.ninja", "kde-frameworks.extra-cmake-modules"},
+	"qmake":    {"dev-qt.qtbase"},
+	"meson":    {"dev-util.meson", "dev-util.ninja", "dev-lang.python"},
+	"scons":    {"dev-util.scons", "dev-lang.python"},
+	"waf":      {"dev-lang.python"},
+	"python":   {"dev-lang.python", "dev-python.pip", "dev-python.setuptools", "dev-python.wheel"},
+	"perl":     {"dev-lang.perl"},
+	"cargo":    {"dev-lang.rust"},
+	"go":       {"dev-lang.go"},
+}
+
+func NewRootfs(osName, arch string, pkgs []string) (Backend, error) {
+	return newRootfs(osName, arch, pkgs, nil)
+}
+
+func newRootfs(osName, arch string, pkgs []string, extra []string) (Backend, error) {
+	cfg := &rootfsConfig{
+		Baselayout: "/pkg/main/azusa.baselayout.core." + osName + "." + arch,
+		Symlinks:   "/pkg/main/azusa.symlinks.core." + osName + "." + arch,
+		Extra:      extra,
+	}
+	for _, p := range []string{cfg.Baselayout, cfg.Symlinks} {
+		if _, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("rootfs: %w", err)
+		}
+	}
+
+	list, err := os.ReadDir("/pkg/main")
+	if err != nil {
+		return nil, err
+	}
+
+	// take all subpackages and versions of each package, for our arch
+	osSuffix := "." + osName + "."
+	for _, f := range list {
+		nam := f.Name()
+		found := false
+		for _, pkg := range pkgs {
+			if strings.HasPrefix(nam, pkg+".") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		if p := strings.LastIndex(nam, osSuffix); p != -1 {
+			if a := nam[p+len(osSuffix):]; !strings.Contains(a, ".") && a != arch {
+				continue
+			}
+		} else if f.Type()&fs.ModeSymlink != 0 {
+			// links without os and arch (eg. azusa.symlinks.core) point to
+			// the host arch, make them point to the same entry for our arch
+			lnk, err := os.Readlink(filepath.Join("/pkg/main", nam))
+			if err != nil {
+				continue
+			}
+			lnk = archLinkTarget(lnk, osName, arch)
+			tgt := lnk
+			if !filepath.IsAbs(tgt) {
+				tgt = filepath.Join("/pkg/main", tgt)
+			}
+			if _, err := os.Stat(tgt); err != nil {
+				// not available for our arch
+				continue
+			}
+			if cfg.Links == nil {
+				cfg.Links = make(map[string]string)
+			}
+			cfg.Links[nam] = lnk
+			continue
+		}
+		cfg.Packages = append(cfg.Packages, nam)
+	}
+	log.Printf("rootfs: using %d entries of /pkg/main from %d packages", len(cfg.Packages)+len(cfg.Links), len(pkgs))
+
+	err = prepareRootfs(cfg)
+	if err != nil {
+		os.RemoveAll(cfg.Dir)
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+
+	b, err := newSandbox(cfg)
+	if err != nil {
+		os.RemoveAll(cfg.Dir)
+		return nil, err
+	}
+	return b, nil
+}
+
+// archLinkTarget returns tgt, the target of a link in /pkg/main, changed to
+// point to the entry for arch
+func archLinkTarget(tgt, osName, arch string) string {
+	osSuffix := "." + osName + "."
+	p := strings.LastIndex(tgt, osSuffix)
+	if p == -1 || strings.Contains(tgt[p+len(osSuffix):], ".") {
+		// not arch specific, such as .any.any
+		return tgt
+	}
+	return tgt[:p+len(osSuffix)] + arch
+}
+
+// rootfsPackages returns the packages (category.name) the rootfs backend
+// should make available for this build
+func (e *buildEnv) rootfsPackages() []string {
+	seen := make(map[string]bool)
+	var res []string
+	add := func(pkg string) {
+		if !seen[pkg] {
+			seen[pkg] = true
+			res = append(res, pkg)
+		}
+	}
+
+	for _, pkg := range rootfsBase {
+		add(pkg)
+	}
+
+	if f, ok := rootfsEngines[e.i.Engine]; ok {
+		for _, pkg := range f {
+			add(pkg)
+		}
+	} else if e.i.Engine == "auto" || e.i.Engine == "" {
+		// engine will only be known once sources are available
+		for _, f := range rootfsEngines {
+			for _, pkg := range f {
+				add(pkg)
+			}
+		}
+	}
+
+	pcSeen := make(map[string]bool)
+	for _, s := range e.i.Import {
+		if strings.IndexByte(s, '/') == -1 {
+			for _, pkg := range e.pkgConfigPackages(s, pcSeen) {
+				add(pkg)
+			}
+			continue
+		}
+		if p := strings.IndexByte(s, ':'); p != -1 {
+			s = s[:p]
+		}
+		add(strings.ReplaceAll(s, "/", "."))
+	}
+
+	return res
+}
+
+// pkgConfigPackages returns the packages providing a pkg-config module and
+// the modules it requires, based on the links found in azusa.symlinks
+func (e *buildEnv) pkgConfigPackages(name string, seen map[string]bool) []string {
+	if seen[name] {
+		return nil
+	}
+	seen[name] = true
+
+	lnk := "/pkg/main/azusa.symlinks.core." + e.os + "." + e.arch + "/pkgconfig/" + name + ".pc"
+	tgt, err := os.Readlink(lnk)
+	if err != nil {
+		log.Printf("rootfs: could not find pkg-config module %s: %s", name, err)
+		return nil
+	}
+	if !filepath.IsAbs(tgt) {
+		tgt = filepath.Join(filepath.Dir(lnk), tgt)
+	}
+
+	var res []string
+
+	// /pkg/main/media-libs.libpng.dev.1.6.37.linux.amd64/lib64/pkgconfig/libpng.pc
+	if rel, err := filepath.Rel("/pkg/main", tgt); err == nil && !strings.HasPrefix(rel, "..") {
+		pkg := strings.SplitN(strings.SplitN(rel, "/", 2)[0], ".", 3)
+		if len(pkg) == 3 {
+			res = append(res, pkg[0]+"."+pkg[1])
+		}
+	}
+
+	data, err := os.ReadFile(lnk)
+	if err != nil {
+		return res
+	}
+	for _, req := range pkgConfigRequires(data) {
+		res = append(res, e.pkgConfigPackages(req, seen)...)
+	}
+	return res
+}
+
+// pkgConfigRequires returns the modules listed in Requires and Requires.private
+// of a .pc file, without their version constraints
+func pkgConfigRequires(data []byte) []string {
+	var res []string
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		p := strings.IndexByte(line, ':')
+		if p == -1 {
+			continue
+		}
+		switch strings.TrimSpace(line[:p]) {
+		case "Requires", "Requires.private":
+		default:
+			continue
+		}
+
+		// "glib-2.0 >= 2.50, zlib", operators don't need spaces around them
+		val := &strings.Builder{}
+		prevOp := false
+		for _, r := range line[p+1:] {
+			op := strings.ContainsRune("<>=!", r)
+			if op != prevOp {
+				val.WriteByte(' ')
+			}
+			val.WriteRune(r)
+			prevOp = op
+		}
+
+		skip := false
+		for _, f := range strings.FieldsFunc(val.String(), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if skip {
+				// version following an operator
+				skip = false
+				continue
+			}
+			switch f {
+			case "=", "<", ">", "<=", ">=", "!=":
+				skip = true
+				continue
+			}
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// prepareRootfs creates the tree used as the root of every command in a
+// temporary directory, with mount points for the packages of cfg. This is
+// done once per build, the directory is removed when the backend is closed.
+func prepareRootfs(cfg *rootfsConfig) error {
+	dir, err := os.MkdirTemp("", "apkg-rootfs-")
+	if err != nil {
+		return err
+	}
+	cfg.Dir = dir
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range []string{"pkg/main", "proc", "dev", "tmp", "usr", "etc", "run", "var/tmp", rootfsBin, rootfsExtra} {
+		err = os.MkdirAll(filepath.Join(dir, d), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = copyTree(cfg.Baselayout, dir)
+	if err != nil {
+		return fmt.Errorf("while copying baselayout: %w", err)
+	}
+
+	// same links as the QEMU init
+	for _, l := range []string{"bin", "sbin", "usr/bin", "usr/sbin", "lib", "lib32", "lib64", "etc/xml"} {
+		tgt := filepath.Join(dir, l)
+		os.RemoveAll(tgt)
+		err = os.Symlink(filepath.Join(cfg.Symlinks, strings.TrimPrefix(l, "usr/")), tgt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// ldconfig can't update the read-only /etc, disable it like in the QEMU VM
+	err = os.WriteFile(filepath.Join(dir, rootfsBin, "ldconfig"), []byte("#!/bin/bash\n"), 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range cfg.Packages {
+		src := filepath.Join("/pkg/main", p)
+		tgt := filepath.Join(dir, src)
+		st, err := os.Lstat(src)
+		if err != nil {
+			continue
+		}
+		if st.Mode()&fs.ModeSymlink != 0 {
+			lnk, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(lnk, tgt)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.Mkdir(tgt, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	for nam, lnk := range cfg.Links {
+		err = os.Symlink(lnk, filepath.Join(dir, "pkg/main", nam))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range cfg.Extra {
+		priv := filepath.Join(rootfsExtra, filepath.Base(p))
+		err = os.WriteFile(filepath.Join(dir, priv), nil, 0755)
+		if err != nil {
+			return err
+		}
+		err = rootfsLink(dir, p, priv)
+		if err != nil {
+			return fmt.Errorf("while linking %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// rootfsLink creates a link at p in the rootfs tree dir pointing to tgt.
+// Parents of p that link to a package, such as /usr/bin, are replaced with a
+// directory of links to each of their entries, so nothing is written to the
+// package.
+func rootfsLink(dir, p, tgt string) error {
+	parent := "/"
+	for _, c := range strings.Split(strings.Trim(filepath.Dir(p), "/"), "/") {
+		if c == "" {
+			continue
+		}
+		cur := filepath.Join(dir, parent, c)
+		st, err := os.Lstat(cur)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = os.Mkdir(cur, 0755)
+		case err != nil:
+		case st.Mode()&fs.ModeSymlink != 0:
+			err = unfoldLink(cur)
+		case !st.IsDir():
+			err = fmt.Errorf("%s is not a directory", filepath.Join(parent, c))
+		}
+		if err != nil {
+			return err
+		}
+		parent = filepath.Join(parent, c)
+	}
+
+	lnk := filepath.Join(dir, p)
+	os.Remove(lnk)
+	return os.Symlink(tgt, lnk)
+}
+
+// unfoldLink replaces lnk, a link to a directory of a package, with a directory
+// containing a link to each entry of the package directory
+func unfoldLink(lnk string) error {
+	tgt, err := os.Readlink(lnk)
+	if err != nil {
+		return err
+	}
+	// packages are at the same path in the rootfs
+	if !strings.HasPrefix(tgt, "/pkg/main/") {
+		return fmt.Errorf("%s links to %s which is not in a package", lnk, tgt)
+	}
+	list, err := os.ReadDir(tgt)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(lnk)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(lnk, 0755)
+	if err != nil {
+		return err
+	}
+	for _, f := range list {
+		err = os.Symlink(filepath.Join(tgt, f.Name()), filepath.Join(lnk, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootfsSetup builds the root filesystem in root, as a read-only bind of the
+// tree prepared by prepareRootfs with the packages from cfg bind mounted in
+// /pkg/main
+func rootfsSetup(root string, cfg *rootfsConfig, binds []string) error {
+	err := unix.Mount(cfg.Dir, root, "", unix.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("while binding root: %w", err)
+	}
+
+	for _, p := range cfg.Packages {
+		src := filepath.Join("/pkg/main", p)
+		tgt := filepath.Join(root, src)
+		st, err := os.Lstat(tgt)
+		if err != nil || !st.IsDir() {
+			// symlink, or gone since the rootfs was prepared
+			continue
+		}
+		err = unix.Mount(src, tgt, "", unix.MS_BIND|unix.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("while binding %s: %w", src, err)
+		}
+	}
+
+	for _, p := range cfg.Extra {
+		tgt := filepath.Join(root, rootfsExtra, filepath.Base(p))
+		err = unix.Mount(p, tgt, "", unix.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("while binding %s: %w", p, err)
+		}
+		err = unix.MountSetattr(-1, tgt, 0, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+		if err != nil {
+			return fmt.Errorf("while making %s read-only: %w", p, err)
+		}
+	}
+
+	err = unix.Mount("/dev", filepath.Join(root, "dev"), "", unix.MS_BIND|unix.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("while binding /dev: %w", err)
+	}
+
+	// mount points for read-write paths must exist before making the root read-only
+	for _, p := range binds {
+		err = os.MkdirAll(filepath.Join(root, p), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = unix.MountSetattr(-1, root, 0, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+	if err != nil {
+		return fmt.Errorf("while making root read-only: %w", err)
+	}
+
+	return os.Setenv("PATH", rootfsBin+":"+os.Getenv("PATH"))
+}
+
+// copyTree copies the files, links and directories of src into dst
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		tgt := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(tgt, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			lnk, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			os.Remove(tgt)
+			return os.Symlink(lnk, tgt)
+		case d.Type().IsRegular():
+			st, err := d.Info()
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(tgt, data, st.Mode().Perm())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPkgConfigRequires(t *testing.T) {
+	tests := []struct {
+		name string
+		pc   string
+		want []string
+	}{
+		{
+			name: "no requires",
+			pc:   "Name: zlib\nVersion: 1.3.1\nLibs: -lz\n",
+			want: nil,
+		},
+		{
+			name: "requires with versions",
+			pc: `prefix=/pkg/main/x11-libs.cairo.dev
+Name: cairo
+Requires: pixman-1 >= 0.36.0,  fontconfig >= 2.2.95 freetype2>=9.7.3
+Requires.private: zlib, libpng
+Libs: -lcairo
+`,
+			want: []string{"pixman-1", "fontconfig", "freetype2", "zlib", "libpng"},
+		},
+		{
+			name: "spacing and other fields",
+			pc: `Name: foo
+Description: requires: nothing
+Requires :	glib-2.0 != 2.50	gio-2.0
+`,
+			want: []string{"glib-2.0", "gio-2.0"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := pkgConfigRequires([]byte(tt.pc))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: pkgConfigRequires() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArchLinkTarget(t *testing.T) {
+	tests := []struct {
+		tgt, arch, want string
+	}{
+		{"azusa.symlinks.core.linux.amd64", "arm64", "azusa.symlinks.core.linux.arm64"},
+		{"azusa.symlinks.core.linux.amd64", "amd64", "azusa.symlinks.core.linux.amd64"},
+		{"dev-lang.python.core.3.10.2.linux.amd64", "arm64", "dev-lang.python.core.3.10.2.linux.arm64"},
+		{"/pkg/main/sys-devel.gcc.core.13.2.0.linux.amd64", "riscv64", "/pkg/main/sys-devel.gcc.core.13.2.0.linux.riscv64"},
+		{"dev-python.pip.core.23.3.any.any", "arm64", "dev-python.pip.core.23.3.any.any"},
+		{"media-libs.libfoo.dev.1.0.linux.amd64.old", "arm64", "media-libs.libfoo.dev.1.0.linux.amd64.old"},
+	}
+
+	for _, tt := range tests {
+		if got := archLinkTarget(tt.tgt, "linux", tt.arch); got != tt.want {
+			t.Errorf("archLinkTarget(%q, %q) = %q, want %q", tt.tgt, tt.arch, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxInitArg is the first argument apkg-build is re-executed with to set
+// up the sandbox before running a command in it
+const sandboxInitArg = "sandbox-init"
+
+// sandboxBackend runs each command in its own user, mount and pid namespaces
+// (plus network namespace when network is disabled), where everything is
+// read-only except the build directory and the package output directory, with
+// a private /tmp. Files are accessed directly since the writable paths are the
+// same inside and outside the sandbox.
+type sandboxBackend struct {
+	localBackend
+	binds    []string      // read-write paths
+	rootfs   *rootfsConfig // if set, the root is built from packages instead of the host's
+	hostProc bool          // a new /proc can't be mounted
+}
+
+type sandboxConfig struct {
+	Root     string        `json:"root"` // empty directory to build the new root in
+	Dir      string        `json:"dir"`
+	Binds    []string      `json:"binds"`
+	Loopback bool          `json:"loopback"`  // bring up lo in a new network namespace
+	HostProc bool          `json:"host_proc"` // bind the host's /proc instead of mounting a new one
+	Rootfs   *rootfsConfig `json:"rootfs,omitempty"`
+}
+
+func NewSandbox() (Backend, error) {
+	b, err := newSandbox(nil)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newSandbox(rootfs *rootfsConfig) (*sandboxBackend, error) {
+	if os.Getuid() == 0 {
+		// uid 0 would be mapped to the host's root, which keeps all its
+		// capabilities in the user namespace and could remount the root
+		// read-write
+		return nil, errors.New("sandbox: can't be used as root, run apkg-build as a regular user")
+	}
+	b := &sandboxBackend{rootfs: rootfs}
+
+	base, err := b.Base()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{base, apkgOut} {
+		err = os.MkdirAll(p, 0755)
+		if err != nil {
+			return nil, err
+		}
+		b.binds = append(b.binds, p)
+	}
+	if _, err := os.Stat("/pkg/main"); err == nil && rootfs == nil {
+		// rootfs only has some packages
+		b.binds = append(b.binds, "/pkg/main")
+	}
+
+	// make sure namespaces are available
+	buf := &bytes.Buffer{}
+	err = b.RunEnv(context.Background(), "/", []string{"/bin/true"}, nil, io.Discard, buf)
+	if err != nil {
+		// mounting /proc fails in some containers where parts of it are
+		// masked, try again with a bind of the host's /proc
+		b.hostProc = true
+		if b.RunEnv(context.Background(), "/", []string{"/bin/true"}, nil, io.Discard, io.Discard) != nil {
+			return nil, fmt.Errorf("sandbox: failed to run test command: %w: %s", err, strings.TrimSpace(buf.String()))
+		}
+		log.Printf("WARNING: %s, the host's /proc is used instead and shows host processes", strings.TrimSpace(buf.String()))
+	}
+
+	return b, nil
+}
+
+func (b *sandboxBackend) command(dir string, args []string, env []string) (*exec.Cmd, func(), error) {
+	root, err := os.MkdirTemp("", "apkg-sandbox-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		os.Remove(root)
+	}
+
+	cfg, err := json.Marshal(&sandboxConfig{Root: root, Dir: dir, Binds: b.binds, Loopback: b.noNetwork, HostProc: b.hostProc, Rootfs: b.rootfs})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	c := exec.Command("/proc/self/exe", append([]string{sandboxInitArg, string(cfg)}, args...)...)
+	c.Env = env
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}},
+		// needed to setup mounts, dropped by sandboxInit before running the command
+		AmbientCaps: []uintptr{unix.CAP_SYS_ADMIN},
+	}
+	if b.noNetwork {
+		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		c.SysProcAttr.AmbientCaps = append(c.SysProcAttr.AmbientCaps, unix.CAP_NET_ADMIN)
+	}
+
+	return c, cleanup, nil
+}
+
+func (b *sandboxBackend) RunEnv(ctx context.Context, dir string, args []string, env []string, stdout, stderr io.Writer) error {
+	c, cleanup, err := b.command(dir, args, env)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return runCmd(ctx, c, stdout, stderr)
+}
+
+// Close removes the tree prepared for the rootfs, if any
+func (b *sandboxBackend) Close() error {
+	if b.rootfs != nil {
+		return os.RemoveAll(b.rootfs.Dir)
+	}
+	return nil
+}
+
+// SetNetwork is the same as for the local backend, but the test command runs
+// in the sandbox
+func (b *sandboxBackend) SetNetwork(enabled bool) error {
+	if enabled || b.noNetwork {
+		b.noNetwork = !enabled
+		return nil
+	}
+	b.noNetwork = true
+	err := b.RunEnv(context.Background(), "/", []string{"/bin/true"}, nil, io.Discard, nil)
+	if err != nil {
+		b.noNetwork = false
+		return fmt.Errorf("failed to create a network namespace: %w", err)
+	}
+	return nil
+}
+
+func (b *sandboxBackend) Shell(dir string, env []string) error {
+	c, cleanup, err := b.command(dir, []string{"/bin/bash", "-i"}, env)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	return c.Run()
+}
+
+// sandboxInit runs inside the namespaces created for a sandboxed command. It
+// prepares the new root, then runs the command.
+func sandboxInit(args []string) {
+	// capabilities are per thread
+	runtime.LockOSThread()
+
+	err := sandboxSetup(args)
+
+	// only reached if something failed
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+	os.Exit(127)
+}
+
+func sandboxSetup(args []string) error {
+	if len(args) < 2 {
+		return errors.New("missing command")
+	}
+
+	cfg := &sandboxConfig{}
+	err := json.Unmarshal([]byte(args[0]), cfg)
+	if err != nil {
+		return err
+	}
+	root := cfg.Root
+
+	// make sure nothing we do is visible outside
+	err = unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("while making mounts private: %w", err)
+	}
+
+	if cfg.Rootfs != nil {
+		err = rootfsSetup(root, cfg.Rootfs, cfg.Binds)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = unix.Mount("/", root, "", unix.MS_BIND|unix.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("while binding root: %w", err)
+		}
+		err = unix.MountSetattr(-1, root, unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+		if err != nil {
+			return fmt.Errorf("while making root read-only: %w", err)
+		}
+	}
+
+	err = unix.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777")
+	if err != nil {
+		return fmt.Errorf("while mounting /tmp: %w", err)
+	}
+
+	for _, p := range cfg.Binds {
+		tgt := filepath.Join(root, p)
+		// only needed for paths in /tmp
+		os.MkdirAll(tgt, 0755)
+		err = unix.Mount(p, tgt, "", unix.MS_BIND|unix.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("while binding %s: %w", p, err)
+		}
+	}
+
+	if cfg.Loopback {
+		err = loopbackUp()
+		if err != nil {
+			return fmt.Errorf("while bringing up lo: %w", err)
+		}
+	}
+
+	if cfg.HostProc {
+		err = unix.Mount("/proc", filepath.Join(root, "proc"), "", unix.MS_BIND|unix.MS_REC, "")
+	} else {
+		err = unix.Mount("proc", filepath.Join(root, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+	}
+	if err != nil {
+		return fmt.Errorf("while mounting /proc: %w", err)
+	}
+
+	err = os.Chdir(root)
+	if err != nil {
+		return err
+	}
+	err = unix.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	err = unix.Unmount(".", unix.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("while detaching old root: %w", err)
+	}
+	err = os.Chdir(cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	// the command runs as the same, non-root, user without any capability
+	err = dropInheritableCaps()
+	if err != nil {
+		return fmt.Errorf("while dropping capabilities: %w", err)
+	}
+
+	bin, err := exec.LookPath(args[1])
+	if err != nil {
+		return err
+	}
+	return sandboxRun(bin, args[1:])
+}
+
+// sandboxRun runs the command as a child, as we are PID 1 of the pid namespace
+// and must reap orphaned processes, then exits with its status
+func sandboxRun(bin string, args []string) error {
+	// signals from the terminal already reach the whole process group, only
+	// forward the ones sent to us
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, unix.SIGINT, unix.SIGQUIT, unix.SIGTERM, unix.SIGHUP)
+
+	p, err := os.StartProcess(bin, args, &os.ProcAttr{Env: os.Environ(), Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for s := range sig {
+			if s == unix.SIGTERM || s == unix.SIGHUP {
+				p.Signal(s)
+			}
+		}
+	}()
+
+	for {
+		var st unix.WaitStatus
+		pid, err := unix.Wait4(-1, &st, 0, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if pid != p.Pid {
+			continue
+		}
+		if st.Signaled() {
+			os.Exit(128 + int(st.Signal()))
+		}
+		os.Exit(st.ExitStatus())
+	}
+}
+
+// dropInheritableCaps clears the ambient capabilities used to set up
+// namespaces, and the inheritable set so files with capabilities can't get
+// them back
+func dropInheritableCaps() error {
+	err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	hdr := &unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	caps := make([]unix.CapUserData, 2)
+	err = unix.Capget(hdr, &caps[0])
+	if err != nil {
+		return err
+	}
+	caps[0].Inheritable = 0
+	caps[1].Inheritable = 0
+	return unix.Capset(hdr, &caps[0])
+}
+
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	ifr.SetUint16(unix.IFF_UP | unix.IFF_LOOPBACK | unix.IFF_RUNNING)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildScons() (*engineSteps, error) {
+	// allow override of sconsRoot via SCONS_ROOT
+	sconsRoot := e.src
+	if v := e.getVar("SCONS_ROOT"); v != "" {
+		sconsRoot = v
+	}
+
+	sconsVars := []string{
+		"PREFIX=" + e.getDir("core"),
+		"LIBDIR=" + e.getDir("libs") + "/lib" + e.libsuffix,
+		"INCLUDEDIR=" + e.getDir("dev") + "/include",
+	}
+
+	// Process custom arguments from build.yaml
+	for _, arg := range e.i.Arguments {
+		arg, err := shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		sconsVars = append(sconsVars, arg)
+	}
+
+	// scons builds in tree
+	buildDir := sconsRoot
+
+	return &engineSteps{
+		dir: buildDir,
+		compile: func() error {
+			return e.runIn(buildDir, append([]string{"scons", "-j" + strconv.Itoa(runtime.NumCPU())}, sconsVars...)...)
+		},
+		install: func() error {
+			return e.runIn(buildDir, append([]string{"scons", "install", "--install-sandbox=" + e.dist}, sconsVars...)...)
+		},
+	}, nil
+}
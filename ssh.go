@@ -1,27 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
 )
 
 type sshBackend struct {
-	ssh      *ssh.Client
-	sftp     *sftp.Client
-	useProxy bool
-	uid      int
+	ssh       *ssh.Client
+	sftp      *sftp.Client
+	useProxy  bool
+	uid       int
+	noNetwork bool
 }
 
 func NewSshBackend(s *ssh.Client) (Backend, error) {
@@ -118,7 +126,7 @@ func (b *sshBackend) Remove(p string) error {
 }
 
 func (b *sshBackend) RemoveAll(p string) error {
-	return b.RunEnv("/", []string{"rm", "-fr", p}, nil, nil, nil)
+	return b.RunEnv(context.Background(), "/", []string{"rm", "-fr", p}, nil, nil, nil)
 }
 
 func (b *sshBackend) Rename(oldname, newname string) error {
@@ -204,19 +212,25 @@ func (b *sshBackend) GetFile(remote, local string) error {
 
 func (b *sshBackend) runCapture(args ...string) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	err := b.RunEnv("/", args, nil, buf, nil)
+	err := b.RunEnv(context.Background(), "/", args, nil, buf, nil)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func (b *sshBackend) RunEnv(dir string, args []string, env []string, stdout, stderr io.Writer) error {
+func (b *sshBackend) RunEnv(ctx context.Context, dir string, args []string, env []string, stdout, stderr io.Writer) error {
 	sess, err := b.ssh.NewSession()
 	if err != nil {
 		return err
 	}
-	defer sess.Close()
+	// output is copied until the session is closed, wait for it so the caller
+	// gets all of it
+	var copies sync.WaitGroup
+	defer func() {
+		sess.Close()
+		copies.Wait()
+	}()
 
 	if stdout == nil {
 		stdout = os.Stdout
@@ -251,8 +265,20 @@ func (b *sshBackend) RunEnv(dir string, args []string, env []string, stdout, std
 	if err != nil {
 		return err
 	}
-	go io.Copy(stdout, pipeout)
-	go io.Copy(stderr, pipeerr)
+	pgid := make(chan string, 1)
+	copies.Add(2)
+	go func() {
+		defer copies.Done()
+		// the first line is the process group of the command, see groupCmd
+		r := bufio.NewReader(pipeout)
+		line, _ := r.ReadString('\n')
+		pgid <- strings.TrimSpace(line)
+		io.Copy(stdout, r)
+	}()
+	go func() {
+		defer copies.Done()
+		io.Copy(stderr, pipeerr)
+	}()
 
 	if b.useProxy {
 		// let's use proxy mode
@@ -287,10 +313,149 @@ func (b *sshBackend) RunEnv(dir string, args []string, env []string, stdout, std
 			io.Copy(pipein, bytes.NewReader(v))
 		}()
 
-		return sess.Run(proxy)
+		if b.noNetwork {
+			proxy = "unshare -n " + proxy
+		}
+		return b.runSession(ctx, sess, groupCmd(proxy), pgid)
+	}
+
+	cmd := shellQuoteEnv(env...) + shellQuoteCmd(args...)
+	if b.noNetwork {
+		cmd = "unshare -n " + cmd
+	}
+	return b.runSession(ctx, sess, shellQuoteCmd("cd", dir)+";"+groupCmd(cmd), pgid)
+}
+
+// groupCmd wraps cmd so it runs in its own session and process group, which
+// can be killed as a whole. The command prints its pid, which is also the id of
+// the group, on the first line of stdout before running. It is started in the
+// background so setsid doesn't need to fork, and gets stdin through fd 3 as
+// background commands get /dev/null.
+func groupCmd(cmd string) string {
+	return `exec 3<&0; setsid sh -c 'echo $$; exec "$0" "$@"' ` + cmd + ` <&3 3<&- & wait $!`
+}
+
+// SetNetwork runs the following commands in a new network namespace using
+// unshare, which needs root on the remote side
+func (b *sshBackend) SetNetwork(enabled bool) error {
+	if enabled || b.noNetwork {
+		b.noNetwork = !enabled
+		return nil
+	}
+	if b.uid != 0 {
+		return errors.New("network isolation requires root")
+	}
+	if _, err := b.runCapture("unshare", "-n", "true"); err != nil {
+		return fmt.Errorf("unshare -n failed: %w", err)
+	}
+	b.noNetwork = true
+	return nil
+}
+
+// runSession runs cmd on sess, killing its process group if ctx is done.
+// Signals sent over the session are not enough as servers such as dropbear
+// ignore them.
+func (b *sshBackend) runSession(ctx context.Context, sess *ssh.Session, cmd string, pgid <-chan string) error {
+	err := sess.Start(cmd)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		b.killGroup(pgid)
+		sess.Signal(ssh.SIGKILL)
+		sess.Close()
+		return ctx.Err()
+	}
+}
+
+// killGroup kills the process group of a command started with groupCmd, once
+// it is known
+func (b *sshBackend) killGroup(pgid <-chan string) {
+	var id string
+	select {
+	case id = <-pgid:
+	case <-time.After(5 * time.Second):
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil || n <= 1 {
+		log.Printf("ssh: process group of the command is unknown, closing the session instead")
+		return
 	}
 
-	return sess.Run(shellQuoteCmd("cd", dir) + ";" + shellQuoteEnv(env...) + shellQuoteCmd(args...))
+	sess, err := b.ssh.NewSession()
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	if err := sess.Run("kill -9 -" + id); err != nil {
+		log.Printf("ssh: failed to kill process group %s: %s", id, err)
+	}
+}
+
+func (b *sshBackend) Shell(dir string, env []string) error {
+	sess, err := b.ssh.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	fd := int(os.Stdin.Fd())
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	w, h := 80, 24
+	if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+		w, h = int(ws.Col), int(ws.Row)
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	err = sess.RequestPty(term, h, w, modes)
+	if err != nil {
+		return err
+	}
+
+	// the remote pty handles echo & line editing
+	if restore, err := makeRaw(fd); err == nil {
+		defer restore()
+	}
+
+	// follow changes of our terminal size
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, unix.SIGWINCH)
+	defer func() {
+		signal.Stop(winch)
+		close(winch)
+	}()
+	go func() {
+		for range winch {
+			if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+				sess.WindowChange(int(ws.Row), int(ws.Col))
+			}
+		}
+	}()
+
+	sess.Stdin = os.Stdin
+	sess.Stdout = os.Stdout
+	sess.Stderr = os.Stderr
+
+	// execproxy takes over stdin, so this always goes through the shell
+	env = append(env, "TERM="+term)
+	return sess.Run(shellQuoteCmd("cd", dir) + ";" + shellQuoteEnv(env...) + shellQuoteCmd("/bin/bash", "-i"))
 }
 
 func (b *sshBackend) FindFiles(dir string, fnList ...string) []string {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// buildState is saved in the build directory after each phase, so a failed
+// build can be resumed from a given phase with -from
+type buildState struct {
+	Done    []string          `yaml:"done"`             // completed phases
+	Failed  string            `yaml:"failed,omitempty"` // phase that failed, if any
+	Dir     string            `yaml:"dir,omitempty"`    // directory of the failed phase
+	Src     string            `yaml:"src"`
+	Engine  string            `yaml:"engine,omitempty"`
+	Options []string          `yaml:"options,flow,omitempty"`
+	Vars    map[string]string `yaml:"vars"`
+	VM      string            `yaml:"vm,omitempty"`         // QEMU VM holding the build directory
+	TestErr string            `yaml:"test_error,omitempty"` // test failure allowed by test_allow_failure
+}
+
+func (e *buildEnv) stateFile() string {
+	return filepath.Join(e.base, "state.yaml")
+}
+
+func (s *buildState) isDone(phase string) bool {
+	for _, p := range s.Done {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *buildEnv) saveState() error {
+	e.state.Src = e.src
+	e.state.Vars = e.vars
+	if qb, ok := e.backend.(*qemuBackend); ok {
+		e.state.VM = qb.vm.id()
+	}
+	e.state.TestErr = ""
+	if e.testErr != nil {
+		e.state.TestErr = e.testErr.Error()
+	}
+	if e.steps != nil {
+		// only save the engine once it is known
+		e.state.Engine = e.i.Engine
+		e.state.Options = e.i.Options
+	}
+
+	data, err := yaml.Marshal(e.state)
+	if err != nil {
+		return err
+	}
+	return e.backend.WriteFile(e.stateFile(), data, 0644)
+}
+
+// readState reads the state saved by a previous build
+func (e *buildEnv) readState() (*buildState, error) {
+	data, err := e.backend.ReadFile(e.stateFile())
+	if err != nil {
+		return nil, fmt.Errorf("no previous build found in %s: %w", e.base, err)
+	}
+
+	st := &buildState{}
+	err = yaml.Unmarshal(data, st)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", e.stateFile(), err)
+	}
+	return st, nil
+}
+
+// restoreState makes the build environment match a previous build
+func (e *buildEnv) restoreState(st *buildState) {
+	e.state = st
+	e.src = st.Src
+	if st.Vars != nil {
+		e.vars = st.Vars
+	}
+	if st.TestErr != "" {
+		e.testErr = errors.New(st.TestErr)
+	}
+	if st.Engine != "" {
+		i := *e.i
+		i.Engine = st.Engine
+		i.Options = st.Options
+		e.i = &i
+	}
+}
+
+// loadState restores the state of a previous build so it can be resumed from
+// phase, which requires all previous phases to have completed
+func (e *buildEnv) loadState(phase string) error {
+	st, err := e.readState()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range buildPhases {
+		if p == phase {
+			break
+		}
+		if !st.isDone(p) {
+			return fmt.Errorf("phase %s of the previous build did not complete, cannot resume from %s", p, phase)
+		}
+	}
+
+	// only keep phases before the one we resume from
+	var done []string
+	for _, p := range buildPhases {
+		if p == phase {
+			break
+		}
+		done = append(done, p)
+	}
+	st.Done = done
+	if !st.isDone(phaseTest) {
+		// tests run again
+		st.TestErr = ""
+	}
+	e.restoreState(st)
+
+	log.Printf("Resuming build of %s from phase %s (previous failure: %s)", e.pkg.fn, phase, st.Failed)
+	return nil
+}
@@ -40,6 +40,17 @@ func cloneFile(src, tgt string) error {
 	return out.Close()
 }
 
+// writeFileRename writes data to fn through a temporary file renamed once
+// complete, so readers never see a partial file
+func writeFileRename(fn string, data []byte, perm fs.FileMode) error {
+	err := os.WriteFile(fn+"~", data, perm)
+	if err != nil {
+		os.Remove(fn + "~")
+		return err
+	}
+	return os.Rename(fn+"~", fn)
+}
+
 func quickMatch(pattern, f string) bool {
 	m, _ := filepath.Match(pattern, f)
 	return m
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+var (
+	// flags of the vm command
+	vmFlags = flag.NewFlagSet("vm", flag.ExitOnError)
+	vmArch  = vmFlags.String("arch", "", "arch of the VMs (default: the global -arch)")
+)
+
+// vmCommand runs apkg-build vm start|stop|status|logs, which manage the QEMU
+// VMs builds run in
+func vmCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: %s vm start|stop|status|logs [-arch arch] [vm...]", os.Args[0])
+	}
+	vmFlags.Parse(args[1:])
+
+	arch := *vmArch
+	if arch == "" {
+		arch = *buildArch
+	}
+
+	switch args[0] {
+	case "start":
+		return vmStart(arch)
+	case "stop":
+		return vmStop(arch, vmFlags.Args())
+	case "status":
+		return vmStatus(arch, vmFlags.Args())
+	case "logs":
+		return vmLogs(arch, vmFlags.Args())
+	}
+	return fmt.Errorf("unknown vm command %s", args[0])
+}
+
+// selectVMs returns the VMs of arch, only keeping the given ones if any
+func selectVMs(arch string, ids []string) ([]*qemuVM, error) {
+	list, err := listQemuVMs(arch)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return list, nil
+	}
+
+	var res []*qemuVM
+	for _, id := range ids {
+		found := false
+		for _, v := range list {
+			if v.id() == id {
+				res = append(res, v)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("VM %s not found", id)
+		}
+	}
+	return res, nil
+}
+
+// vmStart starts a new VM and waits for it to be ready, leaving it idle for
+// the next builds
+func vmStart(arch string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	qc, err := cfg.qemu(arch)
+	if err != nil {
+		return err
+	}
+
+	vm, err := startQemuVM(runtime.GOOS, arch, qc)
+	if err != nil {
+		return err
+	}
+	be, err := vm.waitReady(qc.BootTimeout)
+	if err != nil {
+		return err
+	}
+	be.Close()
+
+	log.Printf("VM %s is ready (pid %d, ssh on port %d)", vm.id(), vm.Pid, vm.Port)
+	return nil
+}
+
+func vmStop(arch string, ids []string) error {
+	list, err := selectVMs(arch, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range list {
+		if !v.tryLock() {
+			log.Printf("VM %s is in use by a build, not stopping it", v.id())
+			continue
+		}
+		if !v.running() {
+			v.remove()
+			continue
+		}
+		log.Printf("Stopping VM %s...", v.id())
+		if err := v.stop(); err != nil {
+			return err
+		}
+		log.Printf("VM %s stopped", v.id())
+	}
+	return nil
+}
+
+func vmStatus(arch string, ids []string) error {
+	list, err := selectVMs(arch, ids)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Printf("No %s VM\n", arch)
+		return nil
+	}
+
+	fmt.Printf("%-20s %8s %6s %-8s %-10s %s\n", "VM", "PID", "PORT", "STATE", "SSH", "UPTIME")
+	for _, v := range list {
+		state := "idle"
+		if v.tryLock() {
+			v.unlock()
+		} else {
+			state = "in use"
+		}
+		ready := "-"
+		uptime := "-"
+		switch {
+		case v.Pid == 0:
+			state = "starting"
+		case !v.running():
+			state = "stopped"
+		default:
+			uptime = time.Since(v.Started).Round(time.Second).String()
+			ready = "booting"
+			if sshc, err := v.dial(); err == nil {
+				sshc.Close()
+				ready = "ready"
+			}
+		}
+		fmt.Printf("%-20s %8d %6d %-8s %-10s %s\n", v.id(), v.Pid, v.Port, state, ready, uptime)
+	}
+	return nil
+}
+
+func vmLogs(arch string, ids []string) error {
+	list, err := selectVMs(arch, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range list {
+		for _, fn := range []string{v.logFile(), v.consoleFile()} {
+			data, err := os.ReadFile(fn)
+			if err != nil {
+				log.Printf("VM %s: %s", v.id(), err)
+				continue
+			}
+			fmt.Printf("==> %s <==\n", fn)
+			os.Stdout.Write(data)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/shell"
+)
+
+func (e *buildEnv) buildWaf() (*engineSteps, error) {
+	// allow override of wafRoot via WAF_ROOT
+	wafRoot := e.src
+	if v := e.getVar("WAF_ROOT"); v != "" {
+		wafRoot = v
+	}
+
+	// use the waf script shipped with the source, unless WAF is set
+	waf := []string{"python3", filepath.Join(wafRoot, "waf")}
+	if v := e.getVar("WAF"); v != "" {
+		waf = strings.Fields(v)
+	}
+	wafCmd := func(args ...string) []string {
+		return append(append([]string{}, waf...), args...)
+	}
+
+	// includedir & mandir are only known to waf if the project loads gnu_dirs,
+	// organize will move these to the right place anyway
+	wafOpts := wafCmd(
+		"configure",
+		"--prefix="+e.getDir("core"),
+		"--libdir="+e.getDir("libs")+"/lib"+e.libsuffix,
+	)
+
+	// Process custom arguments from build.yaml
+	for _, arg := range e.i.Arguments {
+		arg, err := shell.Expand(arg, e.getVar)
+		if err != nil {
+			return nil, err
+		}
+		wafOpts = append(wafOpts, arg)
+	}
+
+	// waf builds in its own out dir, relative to the project
+	buildDir := wafRoot
+
+	return &engineSteps{
+		dir: buildDir,
+		configure: func() error {
+			return e.runIn(buildDir, wafOpts...)
+		},
+		compile: func() error {
+			return e.runIn(buildDir, wafCmd("build", "-j"+strconv.Itoa(runtime.NumCPU()))...)
+		},
+		install: func() error {
+			return e.runIn(buildDir, wafCmd("install", "--destdir="+e.dist)...)
+		},
+	}, nil
+}